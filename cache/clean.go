@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/tracecontext"
+)
+
+const (
+	DefaultMaxCleanDepth = 16
+)
+
+//CleanReport reports entries cleaned by a Clean
+type CleanReport struct {
+	//Attempted is map[dataSourceName]count of ids whose entries are deleted,
+	//ids without entries are counted too, since deletes don't report what existed
+	Attempted map[string]int
+	//Depth is the number of dependency levels walked after the cleaned ids
+	Depth int
+	//Truncated means objects beyond the max depth still depend on cleaned objects
+	Truncated bool
+}
+
+func (r *CleanReport) Total() int {
+	total := 0
+	for _, count := range r.Attempted {
+		total = total + count
+	}
+	return total
+}
+
+//CleanAndReport cleans ids and their dependent objects before returning,
+//the second delete is still scheduled after the double delete delay
+func (c *CacheEngine) CleanAndReport(ctx context.Context, querierName string, ids []string) (*CleanReport, error) {
+	if !c.open {
+		return &CleanReport{Attempted: map[string]int{}}, nil
+	}
+	report, err := c.doClean(ctx, querierName, ids)
+	if err != nil {
+		return nil, err
+	}
+	delay := c.getDoubleDeleteDelay(querierName)
+	if delay > 0 {
+		//the second delete runs after the request, don't bind it to ctx
+		ctx2 := context.Background()
+		badaCtx, ok := tracecontext.GetTraceContext(ctx)
+		if ok {
+			badaCtx.EmbedIntoContext(ctx2)
+		}
+		c.deleter.schedule(delay, func() {
+			_, err := c.doClean(ctx2, querierName, ids)
+			if err != nil {
+				log.Error(ctx2, "doClean failed",
+					log.Err(err),
+					log.String("querierName", querierName),
+					log.Strings("ids", ids))
+			}
+		})
+	}
+	return report, nil
+}
+
+//doClean deletes entries of ids, then walks dependent objects breadth first level by level
+func (c *CacheEngine) doClean(ctx context.Context, querierName string, ids []string) (*CleanReport, error) {
+	return c.cleanExcept(ctx, querierName, ids, nil)
+}
+
+//cleanExcept cleans like doClean, but keeps entries and related ids of ids in kept,
+//their dependent objects are still cleaned and other instances still drop their local copies
+func (c *CacheEngine) cleanExcept(ctx context.Context, querierName string, ids []string, kept map[string]bool) (*CleanReport, error) {
+	_, exists := c.dataSources.Get(querierName)
+	if !exists {
+		log.Error(ctx, "unknown data source",
+			log.String("querierName", querierName),
+			log.Strings("dataSources", c.dataSources.Names()))
+		return nil, ErrUnknownQuerier
+	}
+
+	report := &CleanReport{Attempted: make(map[string]int)}
+	maxDepth := c.getMaxCleanDepth(querierName)
+	//visited is map[querierName][id]
+	visited := make(map[string]map[string]bool)
+	//level is map[querierName][ids]
+	level := map[string][]string{querierName: ids}
+	for depth := 0; ; depth++ {
+		level = c.unvisited(level, visited)
+		if len(level) < 1 {
+			return report, nil
+		}
+		report.Depth = depth
+
+		entryKeys := make([]string, 0)
+		relatedKeys := make([]string, 0)
+		//keptKeys are related keys of kept ids, they're read but not deleted
+		keptKeys := make([]string, 0)
+		//readKeys are related keys read for the next level, readNames are their data sources
+		readKeys := make([]string, 0)
+		readNames := make([]string, 0)
+		for name, levelIDs := range level {
+			evictedIDs := levelIDs
+			if depth == 0 && len(kept) > 0 {
+				keptIDs := make([]string, 0, len(levelIDs))
+				evictedIDs = make([]string, 0, len(levelIDs))
+				for i := range levelIDs {
+					if kept[levelIDs[i]] {
+						keptIDs = append(keptIDs, levelIDs[i])
+					} else {
+						evictedIDs = append(evictedIDs, levelIDs[i])
+					}
+				}
+				keptRelatedKeys := c.keyList(name, keptIDs, c.RelatedIDKey)
+				keptKeys = append(keptKeys, keptRelatedKeys...)
+				readKeys = append(readKeys, keptRelatedKeys...)
+			}
+			evictedRelatedKeys := c.keyList(name, evictedIDs, c.RelatedIDKey)
+			entryKeys = append(entryKeys, c.keyList(name, evictedIDs, c.IDKey)...)
+			relatedKeys = append(relatedKeys, evictedRelatedKeys...)
+			readKeys = append(readKeys, evictedRelatedKeys...)
+			for len(readNames) < len(readKeys) {
+				readNames = append(readNames, name)
+			}
+		}
+		next, err := c.relatedMembers(ctx, readKeys, readNames)
+		if err != nil {
+			return nil, err
+		}
+		//keep related sets beyond the max depth, so that a later clean can still reach them
+		keys := entryKeys
+		if depth < maxDepth {
+			keys = append(keys, relatedKeys...)
+		}
+
+		if c.localCache != nil {
+			c.localGuard.delete(c.localCache, entryKeys...)
+		}
+		err = c.storage.Del(ctx, keys)
+		if err != nil {
+			log.Error(ctx, "Del ids failed", log.Err(err), log.Strings("keys", keys))
+			return nil, err
+		}
+		for name, levelIDs := range level {
+			c.publishInvalidation(ctx, name, levelIDs)
+			report.Attempted[name] = report.Attempted[name] + len(levelIDs)
+		}
+		if depth == 0 && len(kept) > 0 {
+			report.Attempted[querierName] = report.Attempted[querierName] - len(keptKeys)
+		}
+
+		if depth >= maxDepth {
+			report.Truncated = len(c.unvisited(next, visited)) > 0
+			if report.Truncated {
+				log.Warn(ctx, "clean stops at max depth",
+					log.String("querierName", querierName),
+					log.Int("depth", depth))
+			}
+			return report, nil
+		}
+		level = next
+	}
+}
+
+//unvisited drops visited ids from level and marks the others as visited
+func (c *CacheEngine) unvisited(level map[string][]string, visited map[string]map[string]bool) map[string][]string {
+	result := make(map[string][]string)
+	for name, ids := range level {
+		if visited[name] == nil {
+			visited[name] = make(map[string]bool)
+		}
+		for i := range ids {
+			if visited[name][ids[i]] {
+				continue
+			}
+			visited[name][ids[i]] = true
+			result[name] = append(result[name], ids[i])
+		}
+	}
+	return result
+}
+
+//relatedMembers reads related sets in one batch and groups their members by data source,
+//names are the data sources of relatedKeys
+func (c *CacheEngine) relatedMembers(ctx context.Context, relatedKeys []string, names []string) (map[string][]string, error) {
+	//relatedIDMap is map[querierName][relatedIDs]
+	relatedIDMap := make(map[string][]string)
+	legacyCount := 0
+	sets, err := c.storage.SMembersMulti(ctx, relatedKeys)
+	if err != nil {
+		log.Error(ctx, "SMembersMulti failed", log.Err(err), log.Strings("keys", relatedKeys))
+		return nil, err
+	}
+	//embedders is map[querierName][data sources which may embed its objects]
+	var embedders map[string][]string
+	for i, members := range sets {
+		for j := range members {
+			relatedMember, ok := parseRelatedMember(members[j])
+			if ok {
+				relatedIDMap[relatedMember.DataSourceName] = append(relatedIDMap[relatedMember.DataSourceName], relatedMember.ID)
+				continue
+			}
+			//the data source of legacy members is unknown, clean the id in data sources which may embed the object
+			if embedders == nil {
+				embedders = c.dataSources.embedders()
+			}
+			legacyCount++
+			for _, querierName := range embedders[names[i]] {
+				relatedIDMap[querierName] = append(relatedIDMap[querierName], members[j])
+			}
+		}
+	}
+	if legacyCount > 0 {
+		log.Info(ctx, "clean legacy related members",
+			log.Int("count", legacyCount),
+			log.Strings("keys", relatedKeys))
+	}
+	return relatedIDMap, nil
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+)
+
+const (
+	DefaultDoubleDeleteDelay = time.Second * 5
+)
+
+//delayedDeleter runs the second delete of double delete on timers
+type delayedDeleter struct {
+	sync.Mutex
+	pending map[uint64]*time.Timer
+	nextID  uint64
+	wg      sync.WaitGroup
+}
+
+//doubleDelete runs deleteFunc now and again after delay, delay <= 0 skips the second delete
+func (d *delayedDeleter) doubleDelete(delay time.Duration, deleteFunc func()) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		deleteFunc()
+		if delay > 0 {
+			d.schedule(delay, deleteFunc)
+		}
+	}()
+}
+
+func (d *delayedDeleter) schedule(delay time.Duration, deleteFunc func()) {
+	d.Lock()
+	defer d.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[uint64]*time.Timer)
+	}
+	id := d.nextID
+	d.nextID++
+	d.wg.Add(1)
+	d.pending[id] = time.AfterFunc(delay, func() {
+		defer d.wg.Done()
+		d.Lock()
+		delete(d.pending, id)
+		d.Unlock()
+		deleteFunc()
+	})
+}
+
+//wait blocks until every scheduled delete is done or ctx is done
+func (d *delayedDeleter) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+//cancel stops every pending second delete and returns how many are stopped
+func (d *delayedDeleter) cancel() int {
+	d.Lock()
+	defer d.Unlock()
+	count := 0
+	for id, timer := range d.pending {
+		if timer.Stop() {
+			d.wg.Done()
+			count++
+		}
+		delete(d.pending, id)
+	}
+	return count
+}
+
+//WaitPendingDeletes blocks until every delete of Clean, including delayed second deletes, is done
+func (c *CacheEngine) WaitPendingDeletes(ctx context.Context) error {
+	return c.deleter.wait(ctx)
+}
+
+//CancelPendingDeletes drops second deletes not run yet
+func (c *CacheEngine) CancelPendingDeletes(ctx context.Context) {
+	count := c.deleter.cancel()
+	log.Info(ctx, "pending deletes canceled", log.Int("count", count))
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelayedDeleterRunsTwice(t *testing.T) {
+	d := new(delayedDeleter)
+	var calls int32
+	d.doubleDelete(time.Millisecond*20, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := d.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 deletes, got %v", calls)
+	}
+}
+
+func TestDelayedDeleterCancel(t *testing.T) {
+	d := new(delayedDeleter)
+	var calls int32
+	d.doubleDelete(time.Hour, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+	//wait for the first delete to schedule the second one
+	for i := 0; i < 100 && d.cancel() == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := d.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 delete, got %v", calls)
+	}
+}
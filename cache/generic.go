@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/dbo"
+)
+
+//ITypedDataSource is an IDataSource returning objects of type T
+type ITypedDataSource[T Object] interface {
+	QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]T, error)
+	Name() string
+}
+
+type ITypedConditionalDataSource[T Object] interface {
+	ITypedDataSource[T]
+	ConditionQueryForIDs(ctx context.Context, condition dbo.Conditions, options ...interface{}) ([]string, error)
+}
+
+type typedDataSource[T Object] struct {
+	source ITypedDataSource[T]
+}
+
+func (t *typedDataSource[T]) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]Object, error) {
+	objs, err := t.source.QueryByIDs(ctx, ids, options...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Object, len(objs))
+	for i := range objs {
+		result[i] = objs[i]
+	}
+	return result, nil
+}
+
+func (t *typedDataSource[T]) Name() string {
+	return t.source.Name()
+}
+
+func (t *typedDataSource[T]) RelatedDataSources() []string {
+	related, ok := t.source.(IRelatedDataSource)
+	if !ok {
+		return nil
+	}
+	return related.RelatedDataSources()
+}
+
+type typedConditionalDataSource[T Object] struct {
+	typedDataSource[T]
+	source ITypedConditionalDataSource[T]
+}
+
+func (t *typedConditionalDataSource[T]) ConditionQueryForIDs(ctx context.Context, condition dbo.Conditions, options ...interface{}) ([]string, error) {
+	return t.source.ConditionQueryForIDs(ctx, condition, options...)
+}
+
+//NewDataSource adapts a typed data source for AddDataSource,
+//the result is an IConditionalDataSource if source supports condition search
+func NewDataSource[T Object](source ITypedDataSource[T]) IDataSource {
+	conditional, ok := source.(ITypedConditionalDataSource[T])
+	if ok {
+		return &typedConditionalDataSource[T]{
+			typedDataSource: typedDataSource[T]{source: source},
+			source:          conditional,
+		}
+	}
+	return &typedDataSource[T]{source: source}
+}
+
+type typedObjectSlice[T Object] struct {
+	objs []T
+}
+
+func (t *typedObjectSlice[T]) Decode(data []byte, unmarshal func(data []byte, v interface{}) error) (Object, error) {
+	var obj T
+	//pointer elements are allocated by unmarshal
+	err := unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (t *typedObjectSlice[T]) SetSlice(o []Object) {
+	t.objs = make([]T, 0, len(o))
+	t.Append(o...)
+}
+
+func (t *typedObjectSlice[T]) Iterator(do func(o Object)) {
+	for i := range t.objs {
+		do(t.objs[i])
+	}
+}
+
+func (t *typedObjectSlice[T]) Append(o ...Object) {
+	for i := range o {
+		obj, ok := o[i].(T)
+		if !ok {
+			log.Warn(context.Background(), "drop object of unexpected type",
+				log.Any("object", o[i]),
+				log.String("id", o[i].StringID()))
+			continue
+		}
+		t.objs = append(t.objs, obj)
+	}
+}
+
+func (t *typedObjectSlice[T]) Len() int {
+	return len(t.objs)
+}
+
+func (t *typedObjectSlice[T]) Value() interface{} {
+	return t.objs
+}
+
+//BatchGet is the type safe version of CacheEngine.BatchGet,
+//objects loaded are returned with a *PartialResultError in partial results mode
+func BatchGet[T Object](ctx context.Context,
+	engine *CacheEngine,
+	dataSourceName string,
+	ids []string,
+	expireTime time.Duration,
+	options ...interface{}) ([]T, error) {
+	result := &typedObjectSlice[T]{objs: make([]T, 0, len(ids))}
+	err := engine.batchGet(ctx, dataSourceName, ids, result, expireTime, options...)
+	if _, ok := err.(*PartialResultError); ok {
+		return result.objs, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.objs, nil
+}
+
+//Query is the type safe version of CacheEngine.Query
+func Query[T Object](ctx context.Context,
+	engine *CacheEngine,
+	dataSourceName string,
+	condition dbo.Conditions,
+	expireTime time.Duration,
+	options ...interface{}) ([]T, error) {
+	ids, err := engine.conditionQueryForIDs(ctx, dataSourceName, condition, options...)
+	if err != nil {
+		return nil, err
+	}
+	return BatchGet[T](ctx, engine, dataSourceName, ids, expireTime)
+}
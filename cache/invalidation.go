@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+var (
+	//ErrPubSubUnsupported is storage.ErrPubSubUnsupported, returned by Subscribe and sharded storages alike
+	ErrPubSubUnsupported = storage.ErrPubSubUnsupported
+)
+
+type InvalidationEvent struct {
+	DataSourceName string   `json:"data_source"`
+	IDs            []string `json:"ids"`
+	//Flush means some events may have been lost, every local copy should be dropped
+	Flush bool `json:"-"`
+}
+
+//Subscribe delivers invalidation events published by Clean on every replica until ctx is done,
+//the local cache of the engine is invalidated before handler is called, handler can be nil
+func (c *CacheEngine) Subscribe(ctx context.Context, handler func(ctx context.Context, event *InvalidationEvent)) error {
+	pubSub, ok := c.storage.(storage.IPubSub)
+	if !ok {
+		log.Error(ctx, "storage doesn't support pub/sub")
+		return ErrPubSubUnsupported
+	}
+	messages, err := pubSub.Subscribe(ctx, c.keyBuilder.InvalidationChannel())
+	if err != nil {
+		log.Error(ctx, "Subscribe invalidation failed", log.Err(err))
+		return err
+	}
+	go func() {
+		for msg := range messages {
+			event := &InvalidationEvent{Flush: msg.Reset}
+			if !msg.Reset {
+				err := json.Unmarshal(msg.Payload, event)
+				if err != nil {
+					log.Error(ctx, "Unmarshal invalidation event failed",
+						log.Err(err),
+						log.String("payload", string(msg.Payload)))
+					continue
+				}
+			}
+			c.invalidateLocal(ctx, event)
+			if handler != nil {
+				handler(ctx, event)
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *CacheEngine) invalidateLocal(ctx context.Context, event *InvalidationEvent) {
+	if c.localCache == nil {
+		return
+	}
+	if event.Flush {
+		c.localGuard.purge(c.localCache)
+		return
+	}
+	c.localGuard.delete(c.localCache, c.keyList(event.DataSourceName, event.IDs, c.IDKey)...)
+}
+
+func (c *CacheEngine) publishInvalidation(ctx context.Context, querierName string, ids []string) {
+	pubSub, ok := c.storage.(storage.IPubSub)
+	if !ok || len(ids) < 1 {
+		return
+	}
+	payload, err := json.Marshal(&InvalidationEvent{
+		DataSourceName: querierName,
+		IDs:            ids,
+	})
+	if err != nil {
+		log.Error(ctx, "Marshal invalidation event failed", log.Err(err))
+		return
+	}
+	err = pubSub.Publish(ctx, c.keyBuilder.InvalidationChannel(), payload)
+	if err != nil {
+		log.Error(ctx, "Publish invalidation event failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
+	}
+}
@@ -4,18 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/KL-Engineering/common-log/log"
 	"github.com/KL-Engineering/dbo"
-	"github.com/KL-Engineering/kidsloop-cache/constant"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/keybuilder"
+	"github.com/KL-Engineering/kidsloop-cache/localcache"
 	"github.com/KL-Engineering/kidsloop-cache/statistics"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
 	"github.com/KL-Engineering/kidsloop-cache/utils"
-	"github.com/KL-Engineering/ro"
 	"github.com/KL-Engineering/tracecontext"
-	"github.com/go-redis/redis/v8"
 )
 
 var (
@@ -32,11 +33,34 @@ const (
 	MaxExpireTime = time.Hour * 24
 )
 
+var defaultCodec = new(codec.JSONCodec)
+
 type RelatedEntity struct {
 	DataSourceName string
 	RelatedIDs     []string
 }
 
+//RelatedMember is a member of the related set of an object,
+//it records an object which embeds the object and must be cleaned with it
+type RelatedMember struct {
+	DataSourceName string `json:"data_source"`
+	ID             string `json:"id"`
+}
+
+//parseRelatedMember decodes a member of a related set,
+//members saved by old versions are plain ids without data source
+func parseRelatedMember(member string) (*RelatedMember, bool) {
+	if !strings.HasPrefix(member, "{") {
+		return nil, false
+	}
+	relatedMember := new(RelatedMember)
+	err := json.Unmarshal([]byte(member), relatedMember)
+	if err != nil || relatedMember.DataSourceName == "" || relatedMember.ID == "" {
+		return nil, false
+	}
+	return relatedMember, true
+}
+
 type IConditionalDataSource interface {
 	IDataSource
 	ConditionQueryForIDs(ctx context.Context, condition dbo.Conditions, options ...interface{}) ([]string, error)
@@ -59,60 +83,153 @@ type ICacheEngine interface {
 
 	SetExpire(ctx context.Context, duration time.Duration)
 	OpenCache(ctx context.Context, open bool)
+	SetStorage(ctx context.Context, s storage.IStorage)
+	SetLocalCache(ctx context.Context, localCache localcache.ILocalCache)
+	Subscribe(ctx context.Context, handler func(ctx context.Context, event *InvalidationEvent)) error
 
 	AddDataSource(ctx context.Context, querier IDataSource)
+	RegisterDataSource(ctx context.Context, querier IDataSource) error
+	ReplaceDataSource(ctx context.Context, querier IDataSource) error
+	UnregisterDataSource(ctx context.Context, querierName string) error
+	ValidateDataSources(ctx context.Context) error
+	Put(ctx context.Context, dataSourceName string, objs []Object, expireTime time.Duration) error
+	Refresh(ctx context.Context, dataSourceName string, ids []string) error
+	AddDataSourceWithPolicy(ctx context.Context, querier IDataSource, policy *DataSourcePolicy)
+	SetDataSourcePolicy(ctx context.Context, dataSourceName string, policy *DataSourcePolicy)
+	SetCodec(ctx context.Context, dataSourceName string, objCodec codec.ICodec)
 }
 type CacheEngine struct {
-	querierMap map[string]IDataSource
-	expireTime time.Duration
-	open       bool
+	dataSources *dataSourceRegistry
+	expireTime  time.Duration
+	open        bool
+
+	storage          storage.IStorage
+	keyBuilder       keybuilder.IKeyBuilder
+	hitRatioRecorder *statistics.HitRatioRecorder
+	localCache       localcache.ILocalCache
+	localGuard       localGuard
+	loadGroup        loadGroup
+
+	loadLockLease time.Duration
+	loadLockWait  time.Duration
+
+	compressThreshold   int
+	compressionRecorder *statistics.CompressionRecorder
+
+	leaseTTL time.Duration
+
+	cacheReadTimeout  time.Duration
+	cacheWriteTimeout time.Duration
+	dataSourceTimeout time.Duration
+
+	deleter delayedDeleter
 }
 
 func (c *CacheEngine) SetExpire(ctx context.Context, duration time.Duration) {
 	c.expireTime = duration
 }
 
+//SetStorage replaces the backend of entries, related ids, feedback and statistics
+func (c *CacheEngine) SetStorage(ctx context.Context, s storage.IStorage) {
+	c.storage = s
+	c.resetRecorders()
+}
+
+//SetKeyBuilder replaces the layout of every key, e.g. keybuilder.New("cms:prod") puts keys under a namespace,
+//keys saved by the old key builder are not read any more
+func (c *CacheEngine) SetKeyBuilder(ctx context.Context, keyBuilder keybuilder.IKeyBuilder) {
+	c.keyBuilder = keyBuilder
+	c.resetRecorders()
+}
+
+func (c *CacheEngine) resetRecorders() {
+	c.hitRatioRecorder = statistics.NewHitRatioRecorder(c.storage)
+	c.hitRatioRecorder.SetKeyBuilder(c.keyBuilder)
+	c.compressionRecorder = statistics.NewCompressionRecorder(c.storage)
+	c.compressionRecorder.SetKeyBuilder(c.keyBuilder)
+}
+
+//SetCompressThreshold makes entries larger than threshold bytes saved compressed, threshold <= 0 disables it
+func (c *CacheEngine) SetCompressThreshold(ctx context.Context, threshold int) {
+	c.compressThreshold = threshold
+}
+
+func (c *CacheEngine) CompressionRecorder() *statistics.CompressionRecorder {
+	return c.compressionRecorder
+}
+
+//SetLocalCache puts an in-process cache in front of the storage for the hottest entries,
+//nil disables it
+func (c *CacheEngine) SetLocalCache(ctx context.Context, localCache localcache.ILocalCache) {
+	c.localCache = localCache
+}
+
+func (c *CacheEngine) HitRatioRecorder() *statistics.HitRatioRecorder {
+	return c.hitRatioRecorder
+}
+
+//AddDataSource registers querier or replaces the data source with the same name
 func (c *CacheEngine) AddDataSource(ctx context.Context, querier IDataSource) {
-	c.querierMap[querier.Name()] = querier
+	c.dataSources.Set(querier)
 }
 
+//BatchGet fills result with objects of ids, it fails if the cache or the data source fails,
+//in the mode of WithPartialResults it fills objects loaded and returns a *PartialResultError listing the others
 func (c *CacheEngine) BatchGet(ctx context.Context, querierName string, ids []string, result interface{}, expireTime time.Duration, options ...interface{}) error {
 	s, err := NewReflectObjectSlice(result)
 	if err != nil {
 		log.Error(ctx, "fail to create object slice", log.Err(err), log.Any("result", result))
 		return err
 	}
-	if !c.open {
-		return c.doBatchGetFromDB(ctx, querierName, ids, s, options...)
+	return c.batchGet(ctx, querierName, ids, s, expireTime, options...)
+}
+
+func (c *CacheEngine) batchGet(ctx context.Context, querierName string, ids []string, result objectSlice, expireTime time.Duration, options ...interface{}) error {
+	var err error
+	if !c.enabled(querierName) {
+		err = c.doBatchGetFromDB(ctx, querierName, ids, result, options...)
+	} else {
+		err = c.doBatchGet(ctx, querierName, ids, result, expireTime, options...)
+	}
+	failures, err := partialFailures(err)
+	if err != nil {
+		return err
 	}
-	return c.doBatchGet(ctx, querierName, ids, s, expireTime, options...)
+	return c.partialResult(ctx, querierName, ids, result, failures)
 }
 
-func (c *CacheEngine) doBatchGetFromDB(ctx context.Context, querierName string, ids []string, result *ReflectObjectSlice, options ...interface{}) error {
-	querier, exists := c.querierMap[querierName]
+func (c *CacheEngine) doBatchGetFromDB(ctx context.Context, querierName string, ids []string, result objectSlice, options ...interface{}) error {
+	querier, exists := c.dataSources.Get(querierName)
 	if !exists {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "unknown data source",
 			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
+			log.Strings("dataSources", c.dataSources.Names()))
 		return ErrUnknownQuerier
 	}
 	objs, err := c.batchGetFromDB(ctx, querier, ids, options...)
+	failures, err := partialFailures(err)
 	if err != nil {
 		log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
 		return err
 	}
 	result.Append(objs...)
-	return nil
+	return newPartialError(failures)
 }
 
 func (c *CacheEngine) Clean(ctx context.Context, querierName string, ids []string) {
 	if !c.open {
 		return
 	}
-	c.doubleDelete(ctx, func() {
-		err := c.doClean(ctx, querierName, ids)
+	//the second delete runs after the request, don't bind it to ctx
+	ctx2 := context.Background()
+	badaCtx, ok := tracecontext.GetTraceContext(ctx)
+	if ok {
+		badaCtx.EmbedIntoContext(ctx2)
+	}
+	c.deleter.doubleDelete(c.getDoubleDeleteDelay(querierName), func() {
+		_, err := c.doClean(ctx2, querierName, ids)
 		if err != nil {
-			log.Error(ctx, "doClean failed",
+			log.Error(ctx2, "doClean failed",
 				log.Err(err),
 				log.String("querierName", querierName),
 				log.String("err", err.Error()),
@@ -127,54 +244,73 @@ func (c *CacheEngine) OpenCache(ctx context.Context, open bool) {
 }
 
 func (c *CacheEngine) Query(ctx context.Context, querierName string, condition dbo.Conditions, result interface{}, expireTime time.Duration, options ...interface{}) error {
-	querier, exists := c.querierMap[querierName]
+	ids, err := c.conditionQueryForIDs(ctx, querierName, condition, options...)
+	if err != nil {
+		return err
+	}
+
+	return c.BatchGet(ctx, querierName, ids, result, expireTime)
+}
+
+func (c *CacheEngine) conditionQueryForIDs(ctx context.Context, querierName string, condition dbo.Conditions, options ...interface{}) ([]string, error) {
+	querier, exists := c.dataSources.Get(querierName)
 	if !exists {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "unknown data source",
 			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
-		return ErrUnknownQuerier
+			log.Strings("dataSources", c.dataSources.Names()))
+		return nil, ErrUnknownQuerier
 	}
 	conditionQuerier, ok := querier.(IConditionalDataSource)
 	if !ok {
 		log.Error(ctx, "Querier doesn't support condition search",
 			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
-		return ErrQuerierUnsupportCondition
+			log.Strings("dataSources", c.dataSources.Names()))
+		return nil, ErrQuerierUnsupportCondition
 	}
 	//query by condition for ids
-	ids, err := conditionQuerier.ConditionQueryForIDs(ctx, condition, options...)
+	loadCtx, cancel := withTimeout(ctx, c.dataSourceTimeout)
+	defer cancel()
+	ids, err := conditionQuerier.ConditionQueryForIDs(loadCtx, condition, options...)
 	if err != nil {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "ConditionQueryForIDs failed",
 			log.Err(err),
 			log.Any("condition", condition),
 			log.Any("options", options))
-		return err
+		return nil, err
 	}
+	return ids, nil
+}
 
-	return c.BatchGet(ctx, querierName, ids, result, expireTime)
+//fetchResult is what fetchData loads from the data source
+type fetchResult struct {
+	missingObjs []Object
+	//absentIDs are ids not returned by the data source, they are saved as tombstones
+	absentIDs []string
+	//locks are load locks held
+	locks  *loadLocks
+	leases leases
 }
 
 func (c *CacheEngine) fetchData(ctx context.Context,
 	querierName string,
 	ids []string,
-	result *ReflectObjectSlice, options ...interface{}) ([]Object, error) {
-	querier, exists := c.querierMap[querierName]
+	result objectSlice, options ...interface{}) (*fetchResult, error) {
+	querier, exists := c.dataSources.Get(querierName)
 	if !exists {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "unknown data source",
 			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
+			log.Strings("dataSources", c.dataSources.Names()))
 		return nil, ErrUnknownQuerier
 	}
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return nil, err
-	}
 
 	//query from cache
 	missingIDs := ids
+	hitIDs := make([]string, 0)
+	var failures []*IDFailure
+	var err error
 	if len(ids) > 0 {
-		_, missingIDs, err = c.queryForCache(ctx, querier, client, ids, result)
+		hitIDs, missingIDs, err = c.queryForCache(ctx, querier, ids, result)
+		failures, err = partialFailures(err)
 		if err != nil {
 			log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
 			return nil, err
@@ -183,17 +319,22 @@ func (c *CacheEngine) fetchData(ctx context.Context,
 
 	missingIDsCount := len(missingIDs)
 	allIDsCount := len(ids)
+	//ids neither hit nor missing are tombstones or failed to decode
+	negativeCount := allIDsCount - len(hitIDs) - missingIDsCount - len(failures)
 
 	ctx2 := context.Background()
 	badaCtx, ok := tracecontext.GetTraceContext(ctx)
 	if ok {
 		badaCtx.EmbedIntoContext(ctx2)
 	}
-	go statistics.GetHitRatioRecorder().AddHitRatio(ctx2, allIDsCount-missingIDsCount, missingIDsCount)
+	go func() {
+		c.hitRatioRecorder.AddHitRatio(ctx2, len(hitIDs), missingIDsCount)
+		c.hitRatioRecorder.AddNegativeHit(ctx2, negativeCount)
+	}()
 	//all in cache
 	if missingIDsCount < 1 {
-		log.Info(ctx, "All in cache", log.Any("result", result.slice.Interface()))
-		return nil, nil
+		log.Info(ctx, "All in cache", log.Any("result", result.Value()))
+		return new(fetchResult), newPartialError(failures)
 	} else if missingIDsCount == allIDsCount {
 		log.Info(ctx, "All missing cache",
 			log.Strings("all ids", ids))
@@ -201,53 +342,77 @@ func (c *CacheEngine) fetchData(ctx context.Context,
 		log.Info(ctx, "Parts in cache",
 			log.Strings("missing IDs", missingIDs),
 			log.Strings("all ids", ids),
-			log.Any("result", result.slice.Interface()))
+			log.Any("result", result.Value()))
 	}
 
 	//query from database
-	missingObjs, err := c.batchGetFromDB(ctx, querier, missingIDs, options...)
+	leases := c.acquireLeases(ctx, querierName, missingIDs)
+	var missingObjs []Object
+	var locks *loadLocks
+	if c.loadLockLease > 0 {
+		missingObjs, locks, err = c.lockedGetFromDB(ctx, querier, missingIDs, result, options...)
+	} else {
+		missingObjs, err = c.batchGetFromDB(ctx, querier, missingIDs, options...)
+	}
+	dbFailures, err := partialFailures(err)
 	if err != nil {
 		log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
 		return nil, err
 	}
+	failures = append(failures, dbFailures...)
 	result.Append(missingObjs...)
 
 	c.resort(ctx, ids, result)
-	return missingObjs, nil
+	return &fetchResult{
+		missingObjs: missingObjs,
+		absentIDs:   c.absentIDs(querierName, withoutFailures(missingIDs, dbFailures), result),
+		locks:       locks,
+		leases:      leases,
+	}, newPartialError(failures)
 }
 
 func (c *CacheEngine) doBatchGet(ctx context.Context,
 	querierName string,
 	ids []string,
-	result *ReflectObjectSlice,
+	result objectSlice,
 	expireTime time.Duration,
 	options ...interface{}) error {
-	querier, exists := c.querierMap[querierName]
+	querier, exists := c.dataSources.Get(querierName)
 	if !exists {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "unknown data source",
 			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
+			log.Strings("dataSources", c.dataSources.Names()))
 		return ErrUnknownQuerier
 	}
-	client, err := ro.GetRedis(ctx)
+
+	fetched, err := c.fetchData(ctx, querierName, ids, result, options...)
+	failures, err := partialFailures(err)
 	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
+		log.Error(ctx, "fetchData failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
 		return err
 	}
 
-	missingObjs, err := c.fetchData(ctx, querierName, ids, result, options...)
-
 	//save cache
 	ctx2 := context.Background()
 	badaCtx, ok := tracecontext.GetTraceContext(ctx)
 	if ok {
 		badaCtx.EmbedIntoContext(ctx2)
 	}
-	go c.saveCache(ctx2, querier, client, missingObjs, expireTime)
-	return nil
+	go func() {
+		//the save isn't bound to the request, but limited by the cache write timeout
+		writeCtx, cancel := withTimeout(ctx2, c.cacheWriteTimeout)
+		defer cancel()
+		c.saveCache(writeCtx, querier, fetched.missingObjs, expireTime, fetched.leases)
+		c.saveTombstones(writeCtx, querier, fetched.absentIDs, fetched.leases)
+		c.releaseLoadLocks(writeCtx, querierName, fetched.locks)
+	}()
+	return newPartialError(failures)
 }
 
-func (c *CacheEngine) resort(ctx context.Context, ids []string, result *ReflectObjectSlice) {
+func (c *CacheEngine) resort(ctx context.Context, ids []string, result objectSlice) {
 	resultMap := make(map[string]Object)
 	result.Iterator(func(o Object) {
 		resultMap[o.StringID()] = o
@@ -263,37 +428,6 @@ func (c *CacheEngine) resort(ctx context.Context, ids []string, result *ReflectO
 	result.SetSlice(newResult)
 }
 
-func (c *CacheEngine) doClean(ctx context.Context, querierName string, ids []string) error {
-	querier, exists := c.querierMap[querierName]
-	if !exists {
-		log.Error(ctx, "GetRedis failed",
-			log.String("querierName", querierName),
-			log.Any("querierMap", c.querierMap))
-		return ErrUnknownQuerier
-	}
-
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return err
-	}
-	if len(ids) > 0 {
-		err = client.Del(ctx, c.keyList(querier.Name(), ids, c.IDKey)...).Err()
-		if err != nil {
-			log.Error(ctx, "Del ids failed", log.Err(err), log.Strings("ids", ids))
-			return err
-		}
-	}
-
-	//clean related ids
-	err = c.cleanRelatedIDs(ctx, client, querier, ids)
-	if err != nil {
-		log.Error(ctx, "cleanRelatedIDs failed", log.Err(err), log.Strings("ids", ids))
-		return err
-	}
-	return nil
-}
-
 func (c *CacheEngine) keyList(prefix string, ids []string, idMap func(prefix string, id string) string) []string {
 	keys := make([]string, len(ids))
 	for i := range ids {
@@ -302,135 +436,168 @@ func (c *CacheEngine) keyList(prefix string, ids []string, idMap func(prefix str
 	return keys
 }
 func (c *CacheEngine) IDKey(querierName string, id string) string {
-	return constant.KlcEntryPrefix + querierName + ":" + id
+	return c.keyBuilder.EntryKey(querierName, id)
 }
 func (c *CacheEngine) RelatedIDKey(querierName string, id string) string {
-	return constant.KlcRelatedPrefix + querierName + ":" + id
-}
-func (c *CacheEngine) doubleDelete(ctx context.Context, deleteFunc func()) {
-	go func() {
-		deleteFunc()
-		time.Sleep(time.Second * 5)
-	}()
+	return c.keyBuilder.RelatedKey(querierName, id)
 }
-func (c *CacheEngine) cleanRelatedIDs(ctx context.Context, client *redis.Client, querier IDataSource, ids []string) error {
-	//Query related cache
-	keyList := c.keyList(querier.Name(), ids, c.RelatedIDKey)
-
-	cacheRelatedRes := make([]string, 0)
-	for i := range keyList {
-		tempRes, err := client.SMembers(ctx, keyList[i]).Result()
-		if err != nil {
-			log.Error(ctx, "QueryByIDs failed",
-				log.Err(err),
-				log.Strings("ids", ids))
-			return err
-		}
-		cacheRelatedRes = append(cacheRelatedRes, tempRes...)
-	}
-
-	//Remove related cache
-	for i := range cacheRelatedRes {
-		res := cacheRelatedRes[i]
-		relatedEntity := new(RelatedEntity)
-		err := json.Unmarshal([]byte(res), &relatedEntity)
-		if err != nil {
-			log.Error(ctx, "Unmarshal failed",
-				log.Err(err),
-				log.String("json", res),
-				log.Strings("ids", ids))
-			return err
-		}
-		err = c.doClean(ctx, relatedEntity.DataSourceName, relatedEntity.RelatedIDs)
-		if err != nil {
-			log.Error(ctx, "Clean failed",
-				log.Err(err),
-				log.String("querierName", relatedEntity.DataSourceName),
-				log.Strings("relatedIDs", relatedEntity.RelatedIDs))
-			return err
-		}
-	}
-
-	//delete related
-	if len(keyList) > 0 {
-		err := client.Del(ctx, keyList...).Err()
-		if err != nil {
-			log.Error(ctx, "Del ids failed", log.Err(err), log.Strings("ids", ids))
-			return err
-		}
+func (c *CacheEngine) batchGetFromDB(ctx context.Context,
+	querier IDataSource,
+	missingIDs []string, options ...interface{}) ([]Object, error) {
+	if len(options) > 0 {
+		//options may change the result, only plain id queries are coalesced
+		return c.segmentGetFromDB(ctx, querier, missingIDs, options...)
 	}
-
-	return nil
+	return c.loadGroup.load(ctx, querier.Name(), missingIDs, func(ctx context.Context, ids []string) ([]Object, error) {
+		return c.segmentGetFromDB(ctx, querier, ids)
+	})
 }
-func (c *CacheEngine) batchGetFromDB(ctx context.Context,
+
+func (c *CacheEngine) segmentGetFromDB(ctx context.Context,
 	querier IDataSource,
 	missingIDs []string, options ...interface{}) ([]Object, error) {
-	//query from database segmented
-	missingObjs := make([]Object, 0, len(missingIDs))
-	utils.SegmentLoop(context.Background(), len(missingIDs), 800, func(start, end int) error {
-		segmentObjs, err := querier.QueryByIDs(ctx, missingIDs[start:end], options...)
+	//query from database segmented, segments are merged in the order of ids
+	segment := c.segmentSize(querier.Name())
+	segmentObjs := make([][]Object, (len(missingIDs)+segment-1)/segment)
+	segmentFailures := make([][]*IDFailure, len(segmentObjs))
+	partial := partialResults(ctx)
+	loadCtx, cancel := withTimeout(ctx, c.dataSourceTimeout)
+	defer cancel()
+	err := utils.ParallelSegmentLoop(loadCtx, len(missingIDs), segment, c.segmentParallelism(querier.Name()), func(ctx context.Context, start, end int) error {
+		objs, err := querier.QueryByIDs(ctx, missingIDs[start:end], options...)
 		if err != nil {
 			log.Error(ctx, "QueryByIDs failed",
 				log.Err(err),
-				log.Strings("missingIDs", missingIDs),
+				log.Strings("missingIDs", missingIDs[start:end]),
 				log.Any("options", options))
+			if partial {
+				//the other segments are still loaded
+				segmentFailures[start/segment] = idFailures(missingIDs[start:end], FailureDataSource, err)
+				return nil
+			}
 			return err
 		}
-		missingObjs = append(missingObjs, segmentObjs...)
+		segmentObjs[start/segment] = objs
 		return nil
 	})
-
-	return missingObjs, nil
+	if err != nil {
+		return nil, err
+	}
+	missingObjs := make([]Object, 0, len(missingIDs))
+	failures := make([]*IDFailure, 0)
+	for i := range segmentObjs {
+		missingObjs = append(missingObjs, segmentObjs[i]...)
+		failures = append(failures, segmentFailures[i]...)
+	}
+	return missingObjs, newPartialError(failures)
 }
 
 func (c *CacheEngine) queryForCache(ctx context.Context,
 	querier IDataSource,
-	client *redis.Client,
 	ids []string,
-	result *ReflectObjectSlice) ([]string, []string, error) {
+	result objectSlice) ([]string, []string, error) {
 	missingIDs := make([]string, 0, len(ids))
 	hitIDs := make([]string, 0, len(ids))
-	cacheRes, err := client.MGet(ctx, c.keyList(querier.Name(), ids, c.IDKey)...).Result()
-	if err == redis.Nil {
-		//handle nil
-		fmt.Println("Nil")
-		missingIDs = ids
-	} else {
-		if err != nil {
-			log.Error(ctx, "GetRedis failed", log.Err(err))
-			return nil, nil, err
+	readCtx, cancel := withTimeout(ctx, c.cacheReadTimeout)
+	cacheRes, err := c.getEntries(readCtx, c.keyList(querier.Name(), ids, c.IDKey))
+	readTimeout := readCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	cancel()
+	if err != nil && readTimeout {
+		//a slow cache mustn't block the request, load every id from the data source
+		log.Warn(ctx, "read cache timeout, load from data source",
+			log.Err(err),
+			log.String("querierName", querier.Name()),
+			log.Strings("ids", ids))
+		return hitIDs, append(missingIDs, ids...), nil
+	}
+	if err != nil {
+		log.Error(ctx, "getEntries failed", log.Err(err))
+		return nil, nil, err
+	}
+	//tombstones and entries failed to decode are neither hit nor missing
+	skipped := make(map[string]bool)
+	failures := make([]*IDFailure, 0)
+	for i := range cacheRes {
+		//ids leased are missing until their objects are saved
+		if cacheRes[i] == nil || codec.IsLease(cacheRes[i]) {
+			continue
 		}
-		for i := range cacheRes {
-			res, ok := cacheRes[i].(string)
-			if !ok {
-				continue
-			}
-			obj := result.NewElement()
-			err = json.Unmarshal([]byte(res), &obj)
-			if err != nil {
-				log.Error(ctx, "UnmarshalObject failed",
-					log.Err(err),
-					log.String("res", res))
+		if codec.IsTombstone(cacheRes[i]) {
+			skipped[ids[i]] = true
+			continue
+		}
+		obj, err := result.Decode(cacheRes[i], codec.Decode)
+		if err != nil {
+			log.Error(ctx, "UnmarshalObject failed",
+				log.Err(err),
+				log.String("res", string(cacheRes[i])))
+			if !partialResults(ctx) {
 				return nil, nil, err
 			}
-			result.Append(obj)
+			skipped[ids[i]] = true
+			failures = append(failures, &IDFailure{ID: ids[i], Reason: FailureCacheDecode, Err: err})
+			continue
+		}
+		result.Append(obj)
+	}
+
+	//get missing ids
+	for i := range ids {
+		if skipped[ids[i]] {
+			continue
+		}
+		if !c.containsInObjects(ctx, result, ids[i]) {
+			missingIDs = append(missingIDs, ids[i])
+		} else {
+			hitIDs = append(hitIDs, ids[i])
 		}
+	}
+	return hitIDs, missingIDs, newPartialError(failures)
+}
 
-		//get missing ids
-		for i := range ids {
-			if !c.containsInObjects(ctx, *result, ids[i]) {
-				missingIDs = append(missingIDs, ids[i])
-			} else {
-				hitIDs = append(hitIDs, ids[i])
-			}
+//getEntries reads entries from the local cache first, then from storage
+func (c *CacheEngine) getEntries(ctx context.Context, keys []string) ([][]byte, error) {
+	if c.localCache == nil {
+		return c.storage.MGet(ctx, keys)
+	}
+	values := make([][]byte, len(keys))
+	remoteKeys := make([]string, 0, len(keys))
+	remoteIndexes := make([]int, 0, len(keys))
+	for i := range keys {
+		value, ok := c.localCache.Get(keys[i])
+		if ok {
+			values[i] = value
+			continue
+		}
+		remoteKeys = append(remoteKeys, keys[i])
+		remoteIndexes = append(remoteIndexes, i)
+	}
+	if len(remoteKeys) < 1 {
+		return values, nil
+	}
+	start := c.localGuard.begin()
+	remoteValues, err := c.storage.MGet(ctx, remoteKeys)
+	if err != nil {
+		return nil, err
+	}
+	for i := range remoteValues {
+		if remoteValues[i] == nil {
+			continue
+		}
+		values[remoteIndexes[i]] = remoteValues[i]
+		//leases are replaced soon, don't keep them locally
+		if codec.IsLease(remoteValues[i]) {
+			continue
 		}
+		c.localGuard.set(c.localCache, start, remoteKeys[i], remoteValues[i], 0)
 	}
-	return hitIDs, missingIDs, nil
+	return values, nil
 }
 
 type ObjectRelatedIDs struct {
-	ID         string
-	RelatedIDs []*RelatedEntity
+	DataSourceName string
+	ID             string
+	RelatedIDs     []*RelatedEntity
 }
 type PrepareSavingRelatedIDs struct {
 	querierName     string
@@ -438,44 +605,58 @@ type PrepareSavingRelatedIDs struct {
 	relatedIDs      []string
 }
 
-func (c *CacheEngine) saveRelatedIDs(ctx context.Context,
-	client *redis.Client,
+//relatedSets builds related sets of records which are saved with their entries
+func (c *CacheEngine) relatedSets(ctx context.Context,
 	relatedRecords []*ObjectRelatedIDs,
-	expireAt time.Time,
-	infinite bool) {
+	ttl time.Duration) []*storage.SetEntry {
 	//rebuild structure
-	//relatedIDMap is map[querierName][objectID][relatedIDs]
-	relatedIDMap := make(map[string]map[string][]interface{})
+	//relatedIDMap is map[querierName][objectID][relatedMembers]
+	relatedIDMap := make(map[string]map[string][]string)
 	for i := range relatedRecords {
+		member, err := json.Marshal(&RelatedMember{
+			DataSourceName: relatedRecords[i].DataSourceName,
+			ID:             relatedRecords[i].ID,
+		})
+		if err != nil {
+			log.Error(ctx, "Marshal related member failed", log.Err(err), log.String("id", relatedRecords[i].ID))
+			continue
+		}
 		for j := range relatedRecords[i].RelatedIDs {
-			relatedIDMap = c.handleRelatedEntity(ctx, relatedRecords[i].ID, relatedRecords[i].RelatedIDs[j], relatedIDMap)
+			relatedIDMap = c.handleRelatedEntity(ctx, string(member), relatedRecords[i].RelatedIDs[j], relatedIDMap)
 		}
 	}
 
+	sets := make([]*storage.SetEntry, 0)
 	for querierName, objectMap := range relatedIDMap {
+		_, exists := c.dataSources.Get(querierName)
+		if !exists {
+			//the related set is still saved, but only a data source with the name can clean it
+			log.Warn(ctx, "objects relate to unknown data source", log.String("querierName", querierName))
+		}
 		for objectID, relatedIDs := range objectMap {
-			key := c.RelatedIDKey(querierName, objectID)
-			client.SAdd(ctx, key, relatedIDs...)
-			if !infinite {
-				client.ExpireAt(ctx, key, expireAt)
-			}
+			sets = append(sets, &storage.SetEntry{
+				Key:     c.RelatedIDKey(querierName, objectID),
+				Members: relatedIDs,
+				TTL:     ttl,
+			})
 		}
 	}
+	return sets
 }
 func (c *CacheEngine) handleRelatedEntity(ctx context.Context,
-	objectID string,
+	member string,
 	relatedEntity *RelatedEntity,
-	relatedIDMap map[string]map[string][]interface{}) map[string]map[string][]interface{} {
+	relatedIDMap map[string]map[string][]string) map[string]map[string][]string {
 	for i := range relatedEntity.RelatedIDs {
 		querierNameMap, exist := relatedIDMap[relatedEntity.DataSourceName]
 		if !exist {
-			querierNameMap = make(map[string][]interface{})
+			querierNameMap = make(map[string][]string)
 		}
 		querierIDMap, exist := querierNameMap[relatedEntity.RelatedIDs[i]]
 		if !exist {
-			querierIDMap = make([]interface{}, 0)
+			querierIDMap = make([]string, 0)
 		}
-		querierIDMap = append(querierIDMap, objectID)
+		querierIDMap = append(querierIDMap, member)
 
 		querierNameMap[relatedEntity.RelatedIDs[i]] = querierIDMap
 		relatedIDMap[relatedEntity.DataSourceName] = querierNameMap
@@ -483,55 +664,79 @@ func (c *CacheEngine) handleRelatedEntity(ctx context.Context,
 	return relatedIDMap
 }
 
+//saveCache saves objects leased, every object if leases is nil
 func (c *CacheEngine) saveCache(ctx context.Context,
 	querier IDataSource,
-	client *redis.Client,
 	missingObjs []Object,
-	expireTime time.Duration) {
+	expireTime time.Duration,
+	leases leases) error {
 	//save cache
-	cachePairs := make([]interface{}, len(missingObjs)*2)
+	entries := make([]*storage.Entry, 0, len(missingObjs))
 	relatedRecords := make([]*ObjectRelatedIDs, 0)
 
-	//get Expire
-	now := time.Now()
-	expireAt := now.Add(c.expireTime)
-	infinite := false
-	if expireTime > 0 {
-		expireAt = now.Add(expireTime)
-	}
-	if expireTime == -1 {
-		infinite = true
-	}
-
-	keys := make([]string, len(missingObjs))
+	ttl := c.entryTTL(querier.Name(), expireTime)
+	objCodec := c.getCodec(querier.Name())
+	compressThreshold := c.getCompressThreshold(querier.Name())
+	rawBytes, storedBytes, compressedCount := 0, 0, 0
 	for i := range missingObjs {
-		jsonData, err := json.Marshal(missingObjs[i])
+		if !leases.leased(missingObjs[i].StringID()) {
+			continue
+		}
+		data, err := codec.Encode(objCodec, missingObjs[i])
 		if err != nil {
 			log.Error(ctx, "Marshal data failed", log.Err(err), log.Any("missingObj", missingObjs[i]))
 			continue
 		}
+		if compressThreshold > 0 {
+			rawBytes = rawBytes + len(data)
+			data, err = codec.Compress(data, compressThreshold)
+			if err != nil {
+				log.Error(ctx, "Compress data failed", log.Err(err), log.Any("missingObj", missingObjs[i]))
+				continue
+			}
+			storedBytes = storedBytes + len(data)
+			if codec.Compressed(data) {
+				compressedCount++
+			}
+		}
 		//record := c.collectObjectRelatedIDs(ctx, missingObjs[i])
 		relatedRecords = append(relatedRecords, &ObjectRelatedIDs{
-			ID:         missingObjs[i].StringID(),
-			RelatedIDs: missingObjs[i].RelatedIDs(),
+			DataSourceName: querier.Name(),
+			ID:             missingObjs[i].StringID(),
+			RelatedIDs:     missingObjs[i].RelatedIDs(),
 		})
-		key := c.IDKey(querier.Name(), missingObjs[i].StringID())
-		cachePairs[i*2] = key
-		cachePairs[i*2+1] = jsonData
-
-		keys[i] = key
+		entries = append(entries, &storage.Entry{
+			Key:      c.IDKey(querier.Name(), missingObjs[i].StringID()),
+			Value:    data,
+			TTL:      ttl,
+			Expected: leases[missingObjs[i].StringID()],
+		})
+	}
+	var sets []*storage.SetEntry
+	if !c.policy(querier.Name()).DisableRelated {
+		sets = c.relatedSets(ctx, relatedRecords, ttl)
+	}
+	start := c.localGuard.begin()
+	//entries and related ids are saved together, so that no entry is saved without its related ids
+	entries, err := c.writeBatch(ctx, &storage.Batch{
+		Entries: entries,
+		Sets:    sets,
+	})
+	if err != nil {
+		log.Error(ctx, "Write cache failed", log.Err(err))
+		return err
+	}
+	if rawBytes > 0 {
+		c.compressionRecorder.AddCompression(ctx, querier.Name(), rawBytes, storedBytes, compressedCount)
 	}
-	client.MSet(ctx, cachePairs...)
-	if !infinite {
-		for i := range keys {
-			client.ExpireAt(ctx, keys[i], expireAt)
+	if c.localCache != nil {
+		for i := range entries {
+			c.localGuard.set(c.localCache, start, entries[i].Key, entries[i].Value, entries[i].TTL)
 		}
 	}
-
-	//save related ids
-	c.saveRelatedIDs(ctx, client, relatedRecords, expireAt, infinite)
+	return nil
 }
-func (c *CacheEngine) containsInObjects(Octx context.Context, objs ReflectObjectSlice, id string) bool {
+func (c *CacheEngine) containsInObjects(ctx context.Context, objs objectSlice, id string) bool {
 	flag := false
 	objs.Iterator(func(o Object) {
 		if o.StringID() == id {
@@ -548,11 +753,7 @@ var (
 
 func GetCacheEngine() *CacheEngine {
 	_cacheEngineOnce.Do(func() {
-		_cacheEngine = &CacheEngine{
-			querierMap: make(map[string]IDataSource),
-			expireTime: DefaultExpire,
-			open:       true,
-		}
+		_cacheEngine = New()
 	})
 	return _cacheEngine
 }
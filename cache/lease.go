@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+const (
+	//DefaultLeaseTTL is the lease ttl of engines, it fits most data sources
+	DefaultLeaseTTL = time.Second * 10
+)
+
+//leases maps ids to the lease values taken before loading them, ids with nil values are written without leases,
+//nil means every entry is written without leases, e.g. by the cache refresher
+type leases map[string][]byte
+
+//SetLeaseTTL sets how long a miss holds the lease of an entry, it's DefaultLeaseTTL by default, ttl <= 0 disables leases.
+//A miss saves a lease in the entry key before loading from the data source, Clean deletes it,
+//and the loaded object is saved only if the lease is still there, so that stale objects aren't saved after Clean.
+//Objects loaded longer than ttl aren't saved.
+//The passive refresher replaces expired entries with leases before reloading them.
+//Instances without leases fail to decode lease placeholders, disable leases until every instance sharing the storage is upgraded.
+func (c *CacheEngine) SetLeaseTTL(ctx context.Context, ttl time.Duration) {
+	c.leaseTTL = ttl
+}
+
+//acquireLeases saves leases for ids which have no entry, only objects of ids leased are saved after loading
+func (c *CacheEngine) acquireLeases(ctx context.Context, querierName string, ids []string) leases {
+	if c.leaseTTL <= 0 {
+		return nil
+	}
+	acquired := make(leases)
+	if len(ids) < 1 {
+		return acquired
+	}
+	value := codec.Lease(newLeaseToken())
+	entries := make([]*storage.Entry, len(ids))
+	for i := range ids {
+		entries[i] = &storage.Entry{
+			Key:   c.IDKey(querierName, ids[i]),
+			Value: value,
+			TTL:   c.leaseTTL,
+		}
+	}
+	writeCtx, cancel := withTimeout(ctx, c.cacheWriteTimeout)
+	defer cancel()
+	locked, err := c.storage.SetNX(writeCtx, entries)
+	if err != nil {
+		log.Warn(ctx, "acquire leases failed, objects loaded won't be saved",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
+		return acquired
+	}
+	for i := range ids {
+		if locked[i] {
+			acquired[ids[i]] = value
+		}
+	}
+	return acquired
+}
+
+//acquireExpiredLeases replaces entries of expired ids with leases, so that a Clean during the reload drops the objects loaded.
+//Entries changed since they were read, e.g. leased by another loader, aren't replaced, ids without entries are leased like misses
+func (c *CacheEngine) acquireExpiredLeases(ctx context.Context, querierName string, ids []string) leases {
+	if c.leaseTTL <= 0 || len(ids) < 1 {
+		return nil
+	}
+	keys := make([]string, len(ids))
+	for i := range ids {
+		keys[i] = c.IDKey(querierName, ids[i])
+	}
+	readCtx, cancel := withTimeout(ctx, c.cacheReadTimeout)
+	defer cancel()
+	values, err := c.storage.MGet(readCtx, keys)
+	if err != nil {
+		log.Warn(ctx, "read expired entries failed, objects loaded won't be saved",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
+		return nil
+	}
+
+	value := codec.Lease(newLeaseToken())
+	missingIDs := make([]string, 0, len(ids))
+	expiredIDs := make([]string, 0, len(ids))
+	entries := make([]*storage.Entry, 0, len(ids))
+	for i := range ids {
+		if values[i] == nil {
+			missingIDs = append(missingIDs, ids[i])
+			continue
+		}
+		if codec.IsLease(values[i]) {
+			continue
+		}
+		expiredIDs = append(expiredIDs, ids[i])
+		entries = append(entries, &storage.Entry{
+			Key:      keys[i],
+			Value:    value,
+			TTL:      c.leaseTTL,
+			Expected: values[i],
+		})
+	}
+	acquired := c.acquireLeases(ctx, querierName, missingIDs)
+	if len(entries) < 1 {
+		return acquired
+	}
+	writeCtx, cancel := withTimeout(ctx, c.cacheWriteTimeout)
+	defer cancel()
+	written, err := c.storage.CompareAndWrite(writeCtx, &storage.Batch{Entries: entries})
+	if err != nil {
+		log.Warn(ctx, "acquire leases of expired entries failed, objects loaded won't be saved",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", expiredIDs))
+		return acquired
+	}
+	for i := range expiredIDs {
+		if written[i] {
+			acquired[expiredIDs[i]] = value
+		}
+	}
+	return acquired
+}
+
+//leased reports whether the object of id can be saved
+func (l leases) leased(id string) bool {
+	if l == nil {
+		return true
+	}
+	_, exists := l[id]
+	return exists
+}
+
+//writeBatch writes batch, entries with Expected replace only their leases, it returns entries written
+func (c *CacheEngine) writeBatch(ctx context.Context, batch *storage.Batch) ([]*storage.Entry, error) {
+	leased := false
+	for i := range batch.Entries {
+		if batch.Entries[i].Expected != nil {
+			leased = true
+			break
+		}
+	}
+	if !leased {
+		err := c.storage.Write(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		return batch.Entries, nil
+	}
+
+	written, err := c.storage.CompareAndWrite(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*storage.Entry, 0, len(batch.Entries))
+	for i := range written {
+		if written[i] {
+			entries = append(entries, batch.Entries[i])
+		}
+	}
+	if len(entries) < len(batch.Entries) {
+		log.Info(ctx, "drop entries whose leases are invalidated",
+			log.Int("count", len(batch.Entries)-len(entries)))
+	}
+	return entries, nil
+}
+
+func newLeaseToken() []byte {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+	}
+	return []byte(hex.EncodeToString(token))
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/tracecontext"
+)
+
+type loadCall struct {
+	done chan struct{}
+	obj  Object
+	err  error
+}
+
+//loadGroup coalesces concurrent data source loads, the same (data source, id)
+//is loaded only once at a time and every caller shares the result
+type loadGroup struct {
+	sync.Mutex
+	calls map[string]*loadCall
+}
+
+//load returns objects of ids, ids loading by other callers are waited for and the others are loaded by loadFunc.
+//loadFunc runs on a context detached from ctx, since its result is shared, every caller only waits until its own ctx is done
+func (g *loadGroup) load(ctx context.Context,
+	querierName string,
+	ids []string,
+	loadFunc func(ctx context.Context, ids []string) ([]Object, error)) ([]Object, error) {
+	ownIDs := make([]string, 0, len(ids))
+	ownCalls := make(map[string]*loadCall)
+	waitCalls := make(map[string]*loadCall)
+
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	for i := range ids {
+		if ownCalls[ids[i]] != nil || waitCalls[ids[i]] != nil {
+			continue
+		}
+		key := g.key(querierName, ids[i])
+		call, exists := g.calls[key]
+		if exists {
+			waitCalls[ids[i]] = call
+			continue
+		}
+		call = &loadCall{done: make(chan struct{})}
+		g.calls[key] = call
+		ownCalls[ids[i]] = call
+		ownIDs = append(ownIDs, ids[i])
+	}
+	g.Unlock()
+
+	if len(ownIDs) > 0 {
+		go g.doLoad(detachContext(ctx), querierName, ownIDs, ownCalls, loadFunc)
+	}
+	if len(waitCalls) > 0 {
+		log.Debug(ctx, "wait for loading ids",
+			log.String("querierName", querierName),
+			log.Int("count", len(waitCalls)))
+	}
+
+	result := make([]Object, 0, len(ids))
+	failures := make([]*IDFailure, 0)
+	for _, calls := range []map[string]*loadCall{ownCalls, waitCalls} {
+		for id, call := range calls {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-call.done:
+			}
+			callFailures, err := partialFailures(call.err)
+			if err != nil {
+				//the load may be shared with a caller not in partial results mode
+				if !partialResults(ctx) {
+					return nil, err
+				}
+				callFailures = idFailures([]string{id}, FailureDataSource, err)
+			}
+			//a caller not in partial results mode gets the original error of a load shared with a caller in that mode
+			if len(callFailures) > 0 && !partialResults(ctx) {
+				if callFailures[0].Err != nil {
+					return nil, callFailures[0].Err
+				}
+				return nil, call.err
+			}
+			failures = append(failures, callFailures...)
+			if call.obj != nil {
+				result = append(result, call.obj)
+			}
+		}
+	}
+	return result, newPartialError(failures)
+}
+
+//detachContext returns a context with the trace and the results mode of ctx, but without its deadline and cancellation
+func detachContext(ctx context.Context) context.Context {
+	ctx2 := context.Background()
+	badaCtx, ok := tracecontext.GetTraceContext(ctx)
+	if ok {
+		badaCtx.EmbedIntoContext(ctx2)
+	}
+	if partialResults(ctx) {
+		ctx2 = WithPartialResults(ctx2)
+	}
+	return ctx2
+}
+
+func (g *loadGroup) doLoad(ctx context.Context,
+	querierName string,
+	ids []string,
+	calls map[string]*loadCall,
+	loadFunc func(ctx context.Context, ids []string) ([]Object, error)) {
+	var err error
+	defer func() {
+		g.Lock()
+		for i := range ids {
+			delete(g.calls, g.key(querierName, ids[i]))
+		}
+		g.Unlock()
+		//a partial error fails only the ids listed
+		failures, fatal := partialFailures(err)
+		for i := range failures {
+			call, exists := calls[failures[i].ID]
+			if exists {
+				call.err = newPartialError(failures[i : i+1])
+			}
+		}
+		for i := range ids {
+			if fatal != nil {
+				calls[ids[i]].err = fatal
+			}
+			close(calls[ids[i]].done)
+		}
+	}()
+
+	var objs []Object
+	objs, err = loadFunc(ctx, ids)
+	_, fatal := partialFailures(err)
+	if fatal != nil {
+		return
+	}
+	for i := range objs {
+		call, exists := calls[objs[i].StringID()]
+		if exists {
+			call.obj = objs[i]
+		}
+	}
+}
+
+func (g *loadGroup) key(querierName string, id string) string {
+	return querierName + "\x00" + id
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type loadGroupObject struct {
+	ID string
+}
+
+func (o *loadGroupObject) StringID() string {
+	return o.ID
+}
+func (o *loadGroupObject) RelatedIDs() []*RelatedEntity {
+	return nil
+}
+
+func TestLoadGroupCoalesce(t *testing.T) {
+	ctx := context.Background()
+	g := new(loadGroup)
+	loaded := make(map[string]int)
+	var mutex sync.Mutex
+	var calls int32
+	//every batch has a new id, so every caller starts a load after it joined the loads in flight
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	loadFunc := func(ctx context.Context, ids []string) ([]Object, error) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		<-release
+		mutex.Lock()
+		defer mutex.Unlock()
+		objs := make([]Object, len(ids))
+		for i := range ids {
+			loaded[ids[i]]++
+			objs[i] = &loadGroupObject{ID: ids[i]}
+		}
+		return objs, nil
+	}
+
+	wg := sync.WaitGroup{}
+	batches := [][]string{{"1", "2", "3"}, {"2", "3", "4"}, {"1", "4", "5"}}
+	for i := range batches {
+		wg.Add(1)
+		go func(ids []string) {
+			defer wg.Done()
+			objs, err := g.load(ctx, "source", ids, loadFunc)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(objs) != len(ids) {
+				t.Errorf("unexpected objs: %v", objs)
+			}
+		}(batches[i])
+		<-started
+	}
+	close(release)
+	wg.Wait()
+
+	for id, count := range loaded {
+		if count != 1 {
+			t.Errorf("id %v loaded %v times", id, count)
+		}
+	}
+	if len(loaded) != 5 {
+		t.Errorf("unexpected loaded ids: %v", loaded)
+	}
+}
+
+func TestLoadGroupCallerDeadline(t *testing.T) {
+	g := new(loadGroup)
+	started := make(chan struct{})
+	joined := make(chan struct{})
+	release := make(chan struct{})
+	loadFunc := func(ctx context.Context, ids []string) ([]Object, error) {
+		//the second caller loads "3" on its own after joining the load of "1" and "2"
+		if ids[0] == "3" {
+			close(joined)
+		} else {
+			close(started)
+			<-release
+		}
+		objs := make([]Object, len(ids))
+		for i := range ids {
+			objs[i] = &loadGroupObject{ID: ids[i]}
+		}
+		return objs, nil
+	}
+
+	//the first caller starts the load and leaves early, the second one shares the load
+	shortCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	shortErr := make(chan error, 1)
+	go func() {
+		_, err := g.load(shortCtx, "source", []string{"1", "2"}, loadFunc)
+		shortErr <- err
+	}()
+	<-started
+	go func() {
+		<-joined
+		if err := <-shortErr; err != context.DeadlineExceeded {
+			t.Errorf("unexpected error of short deadline: %v", err)
+		}
+		close(release)
+	}()
+	objs, err := g.load(context.Background(), "source", []string{"1", "2", "3"}, loadFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 3 {
+		t.Fatalf("unexpected objs: %v", objs)
+	}
+}
+
+func TestLoadGroupMixedResultsModes(t *testing.T) {
+	g := new(loadGroup)
+	errLoad := errors.New("load failed")
+	started := make(chan struct{})
+	joined := make(chan struct{})
+	release := make(chan struct{})
+	loadFunc := func(ctx context.Context, ids []string) ([]Object, error) {
+		//the normal caller loads "3" on its own after joining the load of "1" and "2"
+		if ids[0] == "3" {
+			close(joined)
+			return []Object{&loadGroupObject{ID: "3"}}, nil
+		}
+		close(started)
+		<-release
+		if !partialResults(ctx) {
+			t.Errorf("load should run in the results mode of the caller starting it")
+		}
+		return []Object{&loadGroupObject{ID: "1"}}, &PartialResultError{Failures: idFailures([]string{"2"}, FailureDataSource, errLoad)}
+	}
+
+	partialErr := make(chan error, 1)
+	go func() {
+		objs, err := g.load(WithPartialResults(context.Background()), "source", []string{"1", "2"}, loadFunc)
+		if len(objs) != 1 {
+			t.Errorf("unexpected objs: %v", objs)
+		}
+		partialErr <- err
+	}()
+	<-started
+	go func() {
+		<-joined
+		close(release)
+	}()
+	objs, err := g.load(context.Background(), "source", []string{"1", "2", "3"}, loadFunc)
+	if err != errLoad || objs != nil {
+		t.Fatalf("caller not in partial results mode should get the error of the data source: %v, %v", objs, err)
+	}
+	err = <-partialErr
+	var partial *PartialResultError
+	if !errors.As(err, &partial) || len(partial.FailedIDs()) != 1 || partial.FailedIDs()[0] != "2" {
+		t.Fatalf("unexpected partial error: %v", err)
+	}
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("partial error should unwrap to the error of the data source: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+const (
+	defaultLoadLockPollInterval = time.Millisecond * 50
+)
+
+//SetLoadLock makes the first instance missing an id take a lease for loading it,
+//other instances poll the cache for at most waitTimeout before loading from data source,
+//lease <= 0 disables it
+func (c *CacheEngine) SetLoadLock(ctx context.Context, lease time.Duration, waitTimeout time.Duration) {
+	c.loadLockLease = lease
+	c.loadLockWait = waitTimeout
+}
+
+func (c *CacheEngine) LoadLockKey(querierName string, id string) string {
+	return c.keyBuilder.LoadLockKey(querierName, id)
+}
+
+//loadLocks are load locks taken by one acquire, they're released only while they still hold token
+type loadLocks struct {
+	token []byte
+	ids   []string
+}
+
+//lockedGetFromDB loads ids whose lease is taken by this instance and waits for the others,
+//it returns the objects loaded from data source and the locks held, ids failed are returned as a *PartialResultError
+func (c *CacheEngine) lockedGetFromDB(ctx context.Context,
+	querier IDataSource,
+	ids []string,
+	result objectSlice,
+	options ...interface{}) ([]Object, *loadLocks, error) {
+	locks, waitingIDs, err := c.acquireLoadLocks(ctx, querier.Name(), ids)
+	if err != nil {
+		log.Warn(ctx, "acquireLoadLocks failed, load from data source directly",
+			log.Err(err),
+			log.String("querierName", querier.Name()),
+			log.Strings("ids", ids))
+		objs, err := c.batchGetFromDB(ctx, querier, ids, options...)
+		return objs, nil, err
+	}
+
+	objs := make([]Object, 0, len(ids))
+	failures := make([]*IDFailure, 0)
+	if len(locks.ids) > 0 {
+		lockedObjs, err := c.batchGetFromDB(ctx, querier, locks.ids, options...)
+		lockedFailures, err := partialFailures(err)
+		if err != nil {
+			c.releaseLoadLocks(detachContext(ctx), querier.Name(), locks)
+			return nil, nil, err
+		}
+		objs = append(objs, lockedObjs...)
+		failures = append(failures, lockedFailures...)
+	}
+
+	waitingIDs, err = c.waitForLoading(ctx, querier, waitingIDs, result)
+	waitingFailures, err := partialFailures(err)
+	if err != nil {
+		c.releaseLoadLocks(detachContext(ctx), querier.Name(), locks)
+		return nil, nil, err
+	}
+	failures = append(failures, waitingFailures...)
+	if len(waitingIDs) > 0 {
+		log.Info(ctx, "wait for loading timeout, load from data source",
+			log.String("querierName", querier.Name()),
+			log.Strings("ids", waitingIDs))
+		waitingObjs, err := c.batchGetFromDB(ctx, querier, waitingIDs, options...)
+		waitingFailures, err := partialFailures(err)
+		if err != nil {
+			c.releaseLoadLocks(detachContext(ctx), querier.Name(), locks)
+			return nil, nil, err
+		}
+		objs = append(objs, waitingObjs...)
+		failures = append(failures, waitingFailures...)
+	}
+	return objs, locks, newPartialError(failures)
+}
+
+func (c *CacheEngine) acquireLoadLocks(ctx context.Context, querierName string, ids []string) (*loadLocks, []string, error) {
+	locks := &loadLocks{token: newLeaseToken(), ids: make([]string, 0, len(ids))}
+	entries := make([]*storage.Entry, len(ids))
+	for i := range ids {
+		entries[i] = &storage.Entry{
+			Key:   c.LoadLockKey(querierName, ids[i]),
+			Value: locks.token,
+			TTL:   c.loadLockLease,
+		}
+	}
+	writeCtx, cancel := withTimeout(ctx, c.cacheWriteTimeout)
+	defer cancel()
+	locked, err := c.storage.SetNX(writeCtx, entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	waitingIDs := make([]string, 0, len(ids))
+	for i := range ids {
+		if locked[i] {
+			locks.ids = append(locks.ids, ids[i])
+		} else {
+			waitingIDs = append(waitingIDs, ids[i])
+		}
+	}
+	return locks, waitingIDs, nil
+}
+
+//waitForLoading polls the cache until ids are filled by lock holders,
+//it returns ids neither filled nor locked any more before timeout
+func (c *CacheEngine) waitForLoading(ctx context.Context,
+	querier IDataSource,
+	ids []string,
+	result objectSlice) ([]string, error) {
+	failures := make([]*IDFailure, 0)
+	deadline := time.Now().Add(c.loadLockWait)
+	for len(ids) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(defaultLoadLockPollInterval):
+		}
+		_, missingIDs, err := c.queryForCache(ctx, querier, ids, result)
+		decodeFailures, err := partialFailures(err)
+		if err != nil {
+			log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
+			return nil, err
+		}
+		failures = append(failures, decodeFailures...)
+		ids = missingIDs
+		if len(ids) < 1 {
+			break
+		}
+
+		//stop waiting for ids whose holder has finished without filling the cache
+		locks, err := c.storage.MGet(ctx, c.keyList(querier.Name(), ids, c.LoadLockKey))
+		if err != nil {
+			log.Error(ctx, "MGet load locks failed", log.Err(err), log.Strings("ids", ids))
+			return nil, err
+		}
+		released := true
+		for i := range locks {
+			if locks[i] != nil {
+				released = false
+				break
+			}
+		}
+		if released {
+			break
+		}
+	}
+	return ids, newPartialError(failures)
+}
+
+//releaseLoadLocks deletes locks still holding their token, locks expired and taken by others are kept
+func (c *CacheEngine) releaseLoadLocks(ctx context.Context, querierName string, locks *loadLocks) {
+	if locks == nil || len(locks.ids) < 1 {
+		return
+	}
+	entries := make([]*storage.Entry, len(locks.ids))
+	for i := range locks.ids {
+		entries[i] = &storage.Entry{
+			Key:   c.LoadLockKey(querierName, locks.ids[i]),
+			Value: locks.token,
+		}
+	}
+	err := c.storage.CompareAndDel(ctx, entries)
+	if err != nil {
+		log.Warn(ctx, "release load locks failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", locks.ids))
+	}
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/localcache"
+)
+
+const (
+	//maxLocalInvalidations bounds the invalidations tracked, fills started before the bound are skipped
+	maxLocalInvalidations = 4096
+)
+
+//localGuard orders local cache fills with local invalidations,
+//a value read or written before an invalidation of its key isn't put into the local cache
+type localGuard struct {
+	mutex sync.Mutex
+	//generation is bumped by every invalidation
+	generation uint64
+	//floor is the generation of the last purge, fills started before it are skipped
+	floor       uint64
+	invalidated map[string]uint64
+}
+
+//begin returns the generation a fill starts at, call it before reading or writing storage
+func (g *localGuard) begin() uint64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.generation
+}
+
+func (g *localGuard) delete(local localcache.ILocalCache, keys ...string) {
+	g.mutex.Lock()
+	g.generation++
+	if len(g.invalidated)+len(keys) > maxLocalInvalidations {
+		g.invalidated = nil
+		g.floor = g.generation
+	}
+	if g.invalidated == nil {
+		g.invalidated = make(map[string]uint64)
+	}
+	for i := range keys {
+		g.invalidated[keys[i]] = g.generation
+	}
+	g.mutex.Unlock()
+	local.Delete(keys...)
+}
+
+func (g *localGuard) purge(local localcache.ILocalCache) {
+	g.mutex.Lock()
+	g.generation++
+	g.invalidated = nil
+	g.floor = g.generation
+	g.mutex.Unlock()
+	local.Purge()
+}
+
+//set puts the value into the local cache unless key was invalidated after start
+func (g *localGuard) set(local localcache.ILocalCache, start uint64, key string, value []byte, ttl time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.floor > start || g.invalidated[key] > start {
+		return
+	}
+	local.Set(key, value, ttl)
+}
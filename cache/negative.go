@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+//absentIDs returns ids loaded from the data source but not found in result
+func (c *CacheEngine) absentIDs(querierName string, loadedIDs []string, result objectSlice) []string {
+	if c.getNegativeExpire(querierName) <= 0 {
+		return nil
+	}
+	found := make(map[string]bool)
+	result.Iterator(func(o Object) {
+		found[o.StringID()] = true
+	})
+	absentIDs := make([]string, 0)
+	for i := range loadedIDs {
+		if !found[loadedIDs[i]] {
+			absentIDs = append(absentIDs, loadedIDs[i])
+		}
+	}
+	return absentIDs
+}
+
+//saveTombstones saves tombstones of ids leased, every id if leases is nil
+func (c *CacheEngine) saveTombstones(ctx context.Context, querier IDataSource, ids []string, leases leases) {
+	ttl := c.getNegativeExpire(querier.Name())
+	if len(ids) < 1 || ttl <= 0 {
+		return
+	}
+	entries := make([]*storage.Entry, 0, len(ids))
+	for i := range ids {
+		if !leases.leased(ids[i]) {
+			continue
+		}
+		entries = append(entries, &storage.Entry{
+			Key:      c.IDKey(querier.Name(), ids[i]),
+			Value:    codec.Tombstone(),
+			TTL:      ttl,
+			Expected: leases[ids[i]],
+		})
+	}
+	start := c.localGuard.begin()
+	entries, err := c.writeBatch(ctx, &storage.Batch{Entries: entries})
+	if err != nil {
+		log.Error(ctx, "Write tombstones failed",
+			log.Err(err),
+			log.String("querierName", querier.Name()),
+			log.Strings("ids", ids))
+		return
+	}
+	if c.localCache != nil {
+		for i := range entries {
+			c.localGuard.set(c.localCache, start, entries[i].Key, entries[i].Value, entries[i].TTL)
+		}
+	}
+}
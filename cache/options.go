@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/expirecalculator"
+	"github.com/KL-Engineering/kidsloop-cache/keybuilder"
+	"github.com/KL-Engineering/kidsloop-cache/localcache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+type Option func(c *CacheEngine)
+
+//WithStorage sets the backend of the engine, the default is storage.GetRedisStorage()
+func WithStorage(s storage.IStorage) Option {
+	return func(c *CacheEngine) {
+		c.storage = s
+	}
+}
+
+func WithKeyBuilder(keyBuilder keybuilder.IKeyBuilder) Option {
+	return func(c *CacheEngine) {
+		c.keyBuilder = keyBuilder
+	}
+}
+
+//WithNamespace puts keys of the engine under namespace with the default key builder
+func WithNamespace(namespace string) Option {
+	return func(c *CacheEngine) {
+		c.keyBuilder = keybuilder.New(namespace)
+	}
+}
+
+func WithExpire(expire time.Duration) Option {
+	return func(c *CacheEngine) {
+		c.expireTime = expire
+	}
+}
+
+func WithLocalCache(localCache localcache.ILocalCache) Option {
+	return func(c *CacheEngine) {
+		c.localCache = localCache
+	}
+}
+
+func WithLoadLock(lease time.Duration, waitTimeout time.Duration) Option {
+	return func(c *CacheEngine) {
+		c.loadLockLease = lease
+		c.loadLockWait = waitTimeout
+	}
+}
+
+//WithCacheTimeout limits cache reads and writes, see SetCacheTimeout
+func WithCacheTimeout(readTimeout time.Duration, writeTimeout time.Duration) Option {
+	return func(c *CacheEngine) {
+		c.cacheReadTimeout = readTimeout
+		c.cacheWriteTimeout = writeTimeout
+	}
+}
+
+//WithDataSourceTimeout limits loads from data sources, see SetDataSourceTimeout
+func WithDataSourceTimeout(timeout time.Duration) Option {
+	return func(c *CacheEngine) {
+		c.dataSourceTimeout = timeout
+	}
+}
+
+//WithLeaseTTL sets how long a miss holds the lease of an entry, see SetLeaseTTL
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(c *CacheEngine) {
+		c.leaseTTL = ttl
+	}
+}
+
+func WithCompressThreshold(threshold int) Option {
+	return func(c *CacheEngine) {
+		c.compressThreshold = threshold
+	}
+}
+
+func WithDataSources(sources ...IDataSource) Option {
+	return func(c *CacheEngine) {
+		for i := range sources {
+			c.dataSources.Set(sources[i])
+		}
+	}
+}
+
+//WithDataSourcePolicy sets the policy of a data source, the data source can be added later
+func WithDataSourcePolicy(dataSourceName string, policy *DataSourcePolicy) Option {
+	return func(c *CacheEngine) {
+		c.SetDataSourcePolicy(context.Background(), dataSourceName, policy)
+	}
+}
+
+//New creates an engine independent of other engines, engines sharing a storage need different namespaces
+func New(options ...Option) *CacheEngine {
+	c := &CacheEngine{
+		dataSources: newDataSourceRegistry(),
+		leaseTTL:    DefaultLeaseTTL,
+		expireTime:  DefaultExpire,
+		open:        true,
+		storage:     storage.GetRedisStorage(),
+		keyBuilder:  keybuilder.GetKeyBuilder(),
+
+		dataSourceTimeout: DefaultDataSourceTimeout,
+	}
+	for i := range options {
+		options[i](c)
+	}
+	c.resetRecorders()
+	return c
+}
+
+type PassiveRefresherOption func(c *PassiveRefresher)
+
+//WithUpdateFrequency limits expire time calculated by the expire calculator
+func WithUpdateFrequency(maxFrequency, minFrequency time.Duration) PassiveRefresherOption {
+	return func(c *PassiveRefresher) {
+		c.SetUpdateFrequency(maxFrequency, minFrequency)
+	}
+}
+
+func WithExpireCalculator(expireCalculator expirecalculator.IExpireCalculator) PassiveRefresherOption {
+	return func(c *PassiveRefresher) {
+		c.expiredCalculator = expireCalculator
+	}
+}
+
+func NewPassiveRefresher(engine *CacheEngine, options ...PassiveRefresherOption) *PassiveRefresher {
+	c := &PassiveRefresher{
+		engine:             engine,
+		maxUpdateFrequency: defaultUpdateMaxFrequency,
+		minUpdateFrequency: defaultUpdateMinFrequency,
+		expiredCalculator:  expirecalculator.NewExpireCalculator(),
+	}
+	for i := range options {
+		options[i](c)
+	}
+	return c
+}
+
+type CacheRefresherOption func(c *CacheRefresher)
+
+func WithRefreshSize(refreshSize int64) CacheRefresherOption {
+	return func(c *CacheRefresher) {
+		c.refreshSize = refreshSize
+	}
+}
+
+func WithRefreshInterval(refreshInterval time.Duration) CacheRefresherOption {
+	return func(c *CacheRefresher) {
+		c.refreshInterval = refreshInterval
+	}
+}
+
+func NewCacheRefresher(engine *CacheEngine, options ...CacheRefresherOption) *CacheRefresher {
+	c := &CacheRefresher{
+		engine:          engine,
+		refreshSize:     defaultRefreshSize,
+		refreshInterval: defaultRefreshInterval,
+	}
+	for i := range options {
+		options[i](c)
+	}
+	return c
+}
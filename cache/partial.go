@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrObjectMissing = errors.New("object missing")
+)
+
+//FailureReason is why an id isn't in a partial result
+type FailureReason string
+
+const (
+	//FailureCacheDecode means the cached entry can't be decoded
+	FailureCacheDecode FailureReason = "cache_decode"
+	//FailureDataSource means the segment of the id failed in QueryByIDs
+	FailureDataSource FailureReason = "data_source"
+	//FailureMissing means neither the cache nor the data source has the id, including tombstones
+	FailureMissing FailureReason = "missing"
+)
+
+type IDFailure struct {
+	ID     string
+	Reason FailureReason
+	Err    error
+}
+
+//PartialResultError lists ids not loaded, the result still holds every object loaded
+type PartialResultError struct {
+	DataSourceName string
+	Failures       []*IDFailure
+}
+
+func (p *PartialResultError) Error() string {
+	counts := make(map[FailureReason]int)
+	for i := range p.Failures {
+		counts[p.Failures[i].Reason]++
+	}
+	messages := make([]string, 0, len(counts))
+	for reason, count := range counts {
+		messages = append(messages, fmt.Sprintf("%v: %v", reason, count))
+	}
+	sort.Strings(messages)
+	return fmt.Sprintf("partial result of %v, %v ids failed (%v)",
+		p.DataSourceName, len(p.Failures), strings.Join(messages, ", "))
+}
+
+//Unwrap returns the error of the first failure, so that errors.Is finds the cause of a partial result
+func (p *PartialResultError) Unwrap() error {
+	for i := range p.Failures {
+		if p.Failures[i].Err != nil {
+			return p.Failures[i].Err
+		}
+	}
+	return nil
+}
+
+//FailedIDs returns ids failed for reasons, every failed id if reasons is empty
+func (p *PartialResultError) FailedIDs(reasons ...FailureReason) []string {
+	ids := make([]string, 0, len(p.Failures))
+	for i := range p.Failures {
+		if len(reasons) > 0 && !containsReason(reasons, p.Failures[i].Reason) {
+			continue
+		}
+		ids = append(ids, p.Failures[i].ID)
+	}
+	return ids
+}
+
+func containsReason(reasons []FailureReason, reason FailureReason) bool {
+	for i := range reasons {
+		if reasons[i] == reason {
+			return true
+		}
+	}
+	return false
+}
+
+type partialResultsKey struct{}
+
+//WithPartialResults makes BatchGet and Query return objects loaded with a *PartialResultError
+//instead of failing when some ids can't be loaded
+func WithPartialResults(ctx context.Context) context.Context {
+	return context.WithValue(ctx, partialResultsKey{}, true)
+}
+
+func partialResults(ctx context.Context) bool {
+	partial, _ := ctx.Value(partialResultsKey{}).(bool)
+	return partial
+}
+
+//newPartialError returns nil without failures, so that the result can be returned as an error
+func newPartialError(failures []*IDFailure) error {
+	if len(failures) < 1 {
+		return nil
+	}
+	return &PartialResultError{Failures: failures}
+}
+
+//partialFailures splits err into failures of a *PartialResultError and other errors
+func partialFailures(err error) ([]*IDFailure, error) {
+	if err == nil {
+		return nil, nil
+	}
+	partialErr, ok := err.(*PartialResultError)
+	if !ok {
+		return nil, err
+	}
+	return partialErr.Failures, nil
+}
+
+func idFailures(ids []string, reason FailureReason, err error) []*IDFailure {
+	failures := make([]*IDFailure, len(ids))
+	for i := range ids {
+		failures[i] = &IDFailure{ID: ids[i], Reason: reason, Err: err}
+	}
+	return failures
+}
+
+//withoutFailures returns ids without failures, failed ids mustn't be saved as tombstones
+func withoutFailures(ids []string, failures []*IDFailure) []string {
+	if len(failures) < 1 {
+		return ids
+	}
+	failed := make(map[string]bool, len(failures))
+	for i := range failures {
+		failed[failures[i].ID] = true
+	}
+	result := make([]string, 0, len(ids))
+	for i := range ids {
+		if !failed[ids[i]] {
+			result = append(result, ids[i])
+		}
+	}
+	return result
+}
+
+//partialResult reports failures, and ids missing from result in partial results mode
+func (c *CacheEngine) partialResult(ctx context.Context,
+	querierName string,
+	ids []string,
+	result objectSlice,
+	failures []*IDFailure) error {
+	if partialResults(ctx) {
+		reported := make(map[string]bool, len(ids))
+		result.Iterator(func(o Object) {
+			reported[o.StringID()] = true
+		})
+		for i := range failures {
+			reported[failures[i].ID] = true
+		}
+		for i := range ids {
+			if reported[ids[i]] {
+				continue
+			}
+			reported[ids[i]] = true
+			failures = append(failures, &IDFailure{ID: ids[i], Reason: FailureMissing, Err: ErrObjectMissing})
+		}
+	}
+	if len(failures) < 1 {
+		return nil
+	}
+	return &PartialResultError{DataSourceName: querierName, Failures: failures}
+}
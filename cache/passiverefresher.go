@@ -4,18 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/KL-Engineering/common-log/log"
-	"github.com/KL-Engineering/kidsloop-cache/constant"
 	"github.com/KL-Engineering/kidsloop-cache/entity"
 	"github.com/KL-Engineering/kidsloop-cache/expirecalculator"
-	"github.com/KL-Engineering/kidsloop-cache/statistics"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
 	"github.com/KL-Engineering/kidsloop-cache/utils"
-	"github.com/KL-Engineering/ro"
 	"github.com/KL-Engineering/tracecontext"
-	"github.com/go-redis/redis/v8"
 )
 
 const (
@@ -41,6 +39,7 @@ type expiredObject struct {
 type fetchObjectDataResponse struct {
 	dbObjects      map[string]Object
 	expiredObjects map[string]*expiredObject
+	leases         leases
 }
 
 type IPassiveRefresher interface {
@@ -75,11 +74,11 @@ func (c *PassiveRefresher) BatchGet(ctx context.Context,
 	ids []string,
 	res interface{},
 	options ...interface{}) error {
-	querier, exists := c.engine.querierMap[dataSourceName]
+	querier, exists := c.engine.dataSources.Get(dataSourceName)
 	if !exists {
-		log.Error(ctx, "GetRedis failed",
+		log.Error(ctx, "unknown data source",
 			log.String("dataSourceName", dataSourceName),
-			log.Any("querierMap", c.engine.querierMap))
+			log.Strings("dataSources", c.engine.dataSources.Names()))
 		return ErrUnknownQuerier
 	}
 	result, err := NewReflectObjectSlice(res)
@@ -88,17 +87,17 @@ func (c *PassiveRefresher) BatchGet(ctx context.Context,
 		return err
 	}
 	//close cache
-	if !c.engine.open {
-		return c.engine.doBatchGetFromDB(ctx, dataSourceName, ids, result, options...)
-	}
-
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return err
+	if !c.engine.enabled(dataSourceName) {
+		err = c.engine.doBatchGetFromDB(ctx, dataSourceName, ids, result, options...)
+		failures, err := partialFailures(err)
+		if err != nil {
+			return err
+		}
+		return c.engine.partialResult(ctx, dataSourceName, ids, result, failures)
 	}
 
-	objs, err := c.fetchData(ctx, querier, client, ids, result, options...)
+	objs, err := c.fetchData(ctx, querier, ids, result, options...)
+	failures, err := partialFailures(err)
 	if err != nil {
 		log.Error(ctx, "fetchData failed", log.Err(err),
 			log.Strings("ids", ids),
@@ -113,18 +112,21 @@ func (c *PassiveRefresher) BatchGet(ctx context.Context,
 		if ok {
 			badaCtx.EmbedIntoContext(ctx2)
 		}
-		go c.saveCache(ctx2, querier, client, objs)
+		go func() {
+			writeCtx, cancel := withTimeout(ctx2, c.engine.cacheWriteTimeout)
+			defer cancel()
+			c.saveCache(writeCtx, querier, objs)
+		}()
 	}
 
-	return nil
+	return c.engine.partialResult(ctx, dataSourceName, ids, result, failures)
 }
 
 func (c *PassiveRefresher) fetchExpiredData(ctx context.Context,
-	client *redis.Client,
 	querierName string,
 	hitIDs []string,
-	result *ReflectObjectSlice) (map[string]*expiredObject, error) {
-	expiredInfo, err := c.fetchExpireTime(ctx, client, querierName, hitIDs)
+	result objectSlice) (map[string]*expiredObject, error) {
+	expiredInfo, err := c.fetchExpireTime(ctx, querierName, hitIDs)
 	if err != nil {
 		log.Error(ctx, "fetchExpireTime failed",
 			log.Err(err),
@@ -156,24 +158,31 @@ func (c *PassiveRefresher) fetchExpiredData(ctx context.Context,
 
 func (c *PassiveRefresher) fetchData(ctx context.Context,
 	querier IDataSource,
-	client *redis.Client,
 	ids []string,
-	result *ReflectObjectSlice,
+	result objectSlice,
 	options ...interface{}) (*fetchObjectDataResponse, error) {
 
 	//query from cache
 	missingIDs := ids
 	hitIDs := make([]string, 0, len(ids))
+	var failures []*IDFailure
 	var err error
 	if len(ids) > 0 {
-		hitIDs, missingIDs, err = c.engine.queryForCache(ctx, querier, client, ids, result)
+		hitIDs, missingIDs, err = c.engine.queryForCache(ctx, querier, ids, result)
+		failures, err = partialFailures(err)
 		if err != nil {
 			log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
 			return nil, err
 		}
 	}
+	//ids neither hit nor missing are tombstones or failed to decode
+	negativeCount := len(ids) - len(hitIDs) - len(missingIDs) - len(failures)
+
+	//ids missing from cache are leased before loading, expired ids still have entries to replace with leases
+	cacheMissingCount := len(missingIDs)
+
 	//check hitIDs and add expiredIDs into missingIDs
-	expiredObjects, err := c.fetchExpiredData(ctx, client, querier.Name(), hitIDs, result)
+	expiredObjects, err := c.fetchExpiredData(ctx, querier.Name(), hitIDs, result)
 	if err != nil {
 		log.Error(ctx, "fetchExpiredData failed",
 			log.Err(err),
@@ -198,30 +207,39 @@ func (c *PassiveRefresher) fetchData(ctx context.Context,
 		badaCtx.EmbedIntoContext(ctx2)
 	}
 
-	go statistics.GetHitRatioRecorder().AddHitRatio(ctx2, allIDsCount-missingIDsCount, missingIDsCount)
+	go func() {
+		c.engine.hitRatioRecorder.AddHitRatio(ctx2, allIDsCount-missingIDsCount-negativeCount, missingIDsCount)
+		c.engine.hitRatioRecorder.AddNegativeHit(ctx2, negativeCount)
+	}()
 
 	//all in cache
 	if missingIDsCount < 1 {
-		log.Info(ctx, "All in cache", log.Any("result", result.slice.Interface()))
+		log.Info(ctx, "All in cache", log.Any("result", result.Value()))
 		return &fetchObjectDataResponse{
 			dbObjects:      nil,
 			expiredObjects: expiredObjects,
-		}, nil
+		}, newPartialError(failures)
 	} else if missingIDsCount == allIDsCount {
 		log.Info(ctx, "All missing cache",
 			log.Strings("all ids", ids))
 	} else {
 		log.Info(ctx, "Parts in cache",
 			log.Strings("missing IDs", missingIDs),
-			log.Strings("all ids", ids), log.Any("result", result.slice.Interface()))
+			log.Strings("all ids", ids), log.Any("result", result.Value()))
 	}
 
 	//query from database
+	leases := c.engine.acquireLeases(ctx, querier.Name(), missingIDs[:cacheMissingCount])
+	for id, value := range c.engine.acquireExpiredLeases(ctx, querier.Name(), missingIDs[cacheMissingCount:]) {
+		leases[id] = value
+	}
 	missingObjs, err := c.engine.batchGetFromDB(ctx, querier, missingIDs, options...)
+	dbFailures, err := partialFailures(err)
 	if err != nil {
 		log.Error(ctx, "queryForCache failed", log.Err(err), log.Strings("ids", ids))
 		return nil, err
 	}
+	failures = append(failures, dbFailures...)
 	result.Append(missingObjs...)
 
 	c.engine.resort(ctx, ids, result)
@@ -233,11 +251,11 @@ func (c *PassiveRefresher) fetchData(ctx context.Context,
 	return &fetchObjectDataResponse{
 		dbObjects:      dbObjects,
 		expiredObjects: expiredObjects,
-	}, nil
+		leases:         leases,
+	}, newPartialError(failures)
 }
 func (c *PassiveRefresher) saveCache(ctx context.Context,
 	querier IDataSource,
-	client *redis.Client,
 	objs *fetchObjectDataResponse) {
 
 	// maybe needs mutex
@@ -252,9 +270,14 @@ func (c *PassiveRefresher) saveCache(ctx context.Context,
 	}
 
 	//calculate expire time
+	calculator := c.expiredCalculator
+	if policyCalculator := c.engine.policy(querier.Name()).ExpireCalculator; policyCalculator != nil {
+		calculator = policyCalculator
+	}
 	feedbackRecord := make([]*entity.FeedbackRecordEntry, len(feedbackEntities))
+	dbObjects := make([]Object, 0, len(feedbackEntities))
 	for i := range feedbackEntities {
-		expireTime := c.expiredCalculator.Calculate(ctx, feedbackEntities[i])
+		expireTime := calculator.Calculate(ctx, feedbackEntities[i])
 		//limit time
 		expireTime = c.expireLimit(expireTime)
 		feedbackRecord[i] = &entity.FeedbackRecordEntry{
@@ -265,12 +288,15 @@ func (c *PassiveRefresher) saveCache(ctx context.Context,
 		}
 
 		if objs.dbObjects[feedbackEntities[i].ID] != nil {
-			c.engine.saveCache(ctx, querier, client, []Object{objs.dbObjects[feedbackEntities[i].ID]}, MaxExpireTime)
+			dbObjects = append(dbObjects, objs.dbObjects[feedbackEntities[i].ID])
 		}
 	}
+	if len(dbObjects) > 0 {
+		c.engine.saveCache(ctx, querier, dbObjects, MaxExpireTime, objs.leases)
+	}
 
 	//save expirecalculator info
-	c.saveFeedback(ctx, client, querier.Name(), feedbackRecord)
+	c.saveFeedback(ctx, querier.Name(), feedbackRecord)
 }
 
 func (c *PassiveRefresher) fetchObjects(ctx context.Context,
@@ -296,54 +322,57 @@ func (c *PassiveRefresher) fetchObjects(ctx context.Context,
 }
 
 func (c *PassiveRefresher) saveFeedback(ctx context.Context,
-	client *redis.Client,
 	querierName string,
 	newFeedback []*entity.FeedbackRecordEntry) {
 	//save global data & group data
-	globalData := make([]interface{}, len(newFeedback))
-	groupData := make([]interface{}, len(newFeedback))
+	feedbackData := make([]string, len(newFeedback))
 	for i := range newFeedback {
-		globalData[i] = newFeedback[i].CurrentFeedback
-		groupData[i] = newFeedback[i].CurrentFeedback
+		feedbackData[i] = strconv.Itoa(newFeedback[i].CurrentFeedback)
 	}
 
-	//save global data
-	client.LPush(ctx, constant.KlcGlobalFeedbackPrefix, globalData...)
-	//save group data
-	client.LPush(ctx, constant.KlcGroupFeedbackPrefix+querierName, groupData...)
-
-	//pending clean key list
-	cleanKeyList := []string{
-		constant.KlcGlobalFeedbackPrefix,
-		constant.KlcGroupFeedbackPrefix + querierName,
+	//global data, group data, then id data are pushed together
+	lists := make([]*storage.ListEntry, 0, len(newFeedback)+2)
+	lists = append(lists, &storage.ListEntry{Key: c.engine.keyBuilder.GlobalFeedbackKey(), Values: feedbackData})
+	lists = append(lists, &storage.ListEntry{Key: c.engine.keyBuilder.GroupFeedbackKey(querierName), Values: feedbackData})
+	for i := range newFeedback {
+		lists = append(lists, &storage.ListEntry{
+			Key:    c.engine.keyBuilder.IDFeedbackKey(querierName, newFeedback[i].ID),
+			Values: []string{strconv.Itoa(newFeedback[i].CurrentFeedback)},
+		})
+	}
+	err := c.engine.storage.LPushMulti(ctx, lists)
+	if err != nil {
+		log.Error(ctx, "LPushMulti feedback failed", log.Err(err), log.String("querierName", querierName))
 	}
 
-	//save id data
-	for i := range newFeedback {
-		key := idFeedbackPrefix(querierName, newFeedback[i].ID)
-		client.LPush(ctx, key, newFeedback[i].CurrentFeedback)
-		cleanKeyList = append(cleanKeyList, key)
+	//pending clean key list
+	cleanKeyList := make([]string, len(lists))
+	for i := range lists {
+		cleanKeyList[i] = lists[i].Key
 	}
 
 	//save expire
-	c.saveExpireTime(ctx, client, newFeedback)
+	c.saveExpireTime(ctx, newFeedback)
 
-	//clean redis list
-	c.cleanRedisList(ctx, client, cleanKeyList)
+	//clean feedback list
+	c.cleanFeedbackList(ctx, cleanKeyList)
 }
 
-func (c *PassiveRefresher) cleanRedisList(ctx context.Context, client *redis.Client, keys []string) {
+func (c *PassiveRefresher) cleanFeedbackList(ctx context.Context, keys []string) {
 	//TODO: needs to lock
 	for i := range keys {
-		size, err := client.LLen(ctx, keys[i]).Result()
+		size, err := c.engine.storage.LLen(ctx, keys[i])
 		if err != nil {
 			log.Error(ctx, "LLen failed", log.Err(err))
 			return
 		}
+		//keep the latest FeedbackRecordSize records once the list is far longer
 		cleanCount := int(size - entity.FeedbackRecordSize)
 		if cleanCount > entity.FeedbackRecordSize*10 {
-			for j := 0; j < cleanCount; j++ {
-				client.RPop(ctx, keys[i])
+			err = c.engine.storage.LTrim(ctx, keys[i], 0, entity.FeedbackRecordSize-1)
+			if err != nil {
+				log.Error(ctx, "LTrim failed", log.Err(err), log.String("key", keys[i]))
+				return
 			}
 		}
 	}
@@ -352,13 +381,7 @@ func (c *PassiveRefresher) cleanRedisList(ctx context.Context, client *redis.Cli
 func (c *PassiveRefresher) fetchFeedback(ctx context.Context,
 	querierName string,
 	objs *fetchObjectDataResponse) ([]*entity.FeedbackEntry, error) {
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return nil, err
-	}
-
-	globalData, groupData, err := c.fetchGlobalGroupFeedback(ctx, client, querierName)
+	globalData, groupData, err := c.fetchGlobalGroupFeedback(ctx, querierName)
 	if err != nil {
 		log.Error(ctx, "fetchGlobalGroupFeedback failed",
 			log.String("querierName", querierName),
@@ -372,7 +395,7 @@ func (c *PassiveRefresher) fetchFeedback(ctx context.Context,
 	}
 
 	//expired data fetch feedback data
-	idDataMap, err := c.fetchIDFeedback(ctx, client, querierName, ids)
+	idDataMap, err := c.fetchIDFeedback(ctx, querierName, ids)
 	if err != nil {
 		log.Error(ctx, "fetchIDFeedback failed",
 			log.String("querierName", querierName),
@@ -427,23 +450,22 @@ func (c *PassiveRefresher) fetchFeedback(ctx context.Context,
 }
 
 func (c *PassiveRefresher) fetchIDFeedback(ctx context.Context,
-	client *redis.Client,
 	querierName string,
 	ids []string) (map[string][]int, error) {
 
 	idDataMap := make(map[string][]int)
 	for i := range ids {
-		idRaw, err := client.LRange(ctx, idFeedbackPrefix(querierName, ids[i]), 0, entity.FeedbackRecordSize).Result()
-		if err == redis.Nil {
-			continue
-		}
+		idRaw, err := c.engine.storage.LRange(ctx, c.engine.keyBuilder.IDFeedbackKey(querierName, ids[i]), 0, entity.FeedbackRecordSize)
 		if err != nil {
-			log.Error(ctx, "Redis LRange id failed",
+			log.Error(ctx, "LRange id failed",
 				log.String("querierName", querierName),
 				log.String("id", ids[i]),
 				log.Err(err))
 			return nil, err
 		}
+		if len(idRaw) < 1 {
+			continue
+		}
 		idDataMap[ids[i]] = utils.StringsToInts(ctx, idRaw)
 	}
 
@@ -451,11 +473,9 @@ func (c *PassiveRefresher) fetchIDFeedback(ctx context.Context,
 }
 
 func (c *PassiveRefresher) saveExpireTime(ctx context.Context,
-	client *redis.Client,
 	newFeedbacks []*entity.FeedbackRecordEntry) {
 
-	cachePairs := make([]interface{}, 0, len(newFeedbacks)*2)
-	keys := make([]string, len(newFeedbacks))
+	entries := make([]*storage.Entry, 0, len(newFeedbacks))
 	now := time.Now()
 	for i := range newFeedbacks {
 		expireData := &CacheExpire{
@@ -469,45 +489,43 @@ func (c *PassiveRefresher) saveExpireTime(ctx context.Context,
 				log.Err(err))
 			continue
 		}
-		key := idExpirePrefix(newFeedbacks[i].DataSourceName, newFeedbacks[i].ID)
-		value := jsonData
-		cachePairs = append(cachePairs, key)
-		cachePairs = append(cachePairs, value)
-		keys[i] = key
+		entries = append(entries, &storage.Entry{
+			Key:   c.engine.keyBuilder.ExpireKey(newFeedbacks[i].DataSourceName, newFeedbacks[i].ID),
+			Value: jsonData,
+			TTL:   MaxExpireTime,
+		})
 	}
-	client.MSet(ctx, cachePairs...)
-	for i := range keys {
-		client.Expire(ctx, keys[i], MaxExpireTime)
+	err := c.engine.storage.MSet(ctx, entries)
+	if err != nil {
+		log.Error(ctx, "MSet expire time failed", log.Err(err))
 	}
 }
 
 func (c *PassiveRefresher) fetchExpireTime(ctx context.Context,
-	client *redis.Client,
 	querierName string,
 	ids []string) (map[string]*CacheExpire, error) {
 	//expireTime
 	if len(ids) < 1 {
 		return nil, nil
 	}
-	keys := c.engine.keyList(querierName, ids, idExpirePrefix)
-	expireData, err := client.MGet(ctx, keys...).Result()
-	//handle nil
+	keys := c.engine.keyList(querierName, ids, c.engine.keyBuilder.ExpireKey)
+	expireData, err := c.engine.storage.MGet(ctx, keys)
 	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err), log.Strings("keys", keys))
+		log.Error(ctx, "MGet failed", log.Err(err), log.Strings("keys", keys))
 		return nil, err
 	}
 	expireDataMap := make(map[string]*CacheExpire)
 	for i := range expireData {
-		data, ok := expireData[i].(string)
-		if !ok {
+		if expireData[i] == nil {
 			continue
 		}
+		data := expireData[i]
 		expireData := new(CacheExpire)
-		err := json.Unmarshal([]byte(data), expireData)
+		err := json.Unmarshal(data, expireData)
 		if err != nil {
 			log.Error(ctx, "UnmarshalObject failed",
 				log.Err(err),
-				log.String("data", data))
+				log.String("data", string(data)))
 			return nil, err
 		}
 		expireDataMap[expireData.ID] = expireData
@@ -516,31 +534,23 @@ func (c *PassiveRefresher) fetchExpireTime(ctx context.Context,
 }
 
 func (c *PassiveRefresher) fetchGlobalGroupFeedback(ctx context.Context,
-	client *redis.Client,
 	querierName string) ([]int, []int, error) {
-	var globalData []int
-	var groupData []int
-
-	globalRaw, err := client.LRange(ctx, constant.KlcGlobalFeedbackPrefix, 0, entity.FeedbackRecordSize).Result()
-	if err != redis.Nil {
-		if err != nil {
-			log.Error(ctx, "Redis LRange global failed",
-				log.Err(err))
-			return nil, nil, err
-		}
-		globalData = utils.StringsToInts(ctx, globalRaw)
+	globalRaw, err := c.engine.storage.LRange(ctx, c.engine.keyBuilder.GlobalFeedbackKey(), 0, entity.FeedbackRecordSize)
+	if err != nil {
+		log.Error(ctx, "LRange global failed",
+			log.Err(err))
+		return nil, nil, err
 	}
+	globalData := utils.StringsToInts(ctx, globalRaw)
 
-	groupRaw, err := client.LRange(ctx, constant.KlcGroupFeedbackPrefix+querierName, 0, entity.FeedbackRecordSize).Result()
-	if err != redis.Nil {
-		if err != nil {
-			log.Error(ctx, "Redis LRange group failed",
-				log.String("querierName", querierName),
-				log.Err(err))
-			return nil, nil, err
-		}
-		groupData = utils.StringsToInts(ctx, groupRaw)
+	groupRaw, err := c.engine.storage.LRange(ctx, c.engine.keyBuilder.GroupFeedbackKey(querierName), 0, entity.FeedbackRecordSize)
+	if err != nil {
+		log.Error(ctx, "LRange group failed",
+			log.String("querierName", querierName),
+			log.Err(err))
+		return nil, nil, err
 	}
+	groupData := utils.StringsToInts(ctx, groupRaw)
 	return globalData, groupData, nil
 }
 
@@ -554,13 +564,6 @@ func (c *PassiveRefresher) expireLimit(expire time.Duration) time.Duration {
 	return expire
 }
 
-func idFeedbackPrefix(querierName string, id string) string {
-	return constant.KlcIDFeedbackPrefix + querierName + ":" + id
-}
-func idExpirePrefix(querierName string, id string) string {
-	return constant.KlcIDExpirePrefix + querierName + ":" + id
-}
-
 var (
 	_cachePassiveRefresherEngine     *PassiveRefresher
 	_cachePassiveRefresherEngineOnce sync.Once
@@ -568,12 +571,8 @@ var (
 
 func GetPassiveCacheRefresher() *PassiveRefresher {
 	_cachePassiveRefresherEngineOnce.Do(func() {
-		_cachePassiveRefresherEngine = &PassiveRefresher{
-			engine:             GetCacheEngine(),
-			maxUpdateFrequency: defaultUpdateMaxFrequency,
-			minUpdateFrequency: defaultUpdateMinFrequency,
-			expiredCalculator:  expirecalculator.GetExpireCalculator(),
-		}
+		_cachePassiveRefresherEngine = NewPassiveRefresher(GetCacheEngine(),
+			WithExpireCalculator(expirecalculator.GetExpireCalculator()))
 	})
 	return _cachePassiveRefresherEngine
 }
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/expirecalculator"
+)
+
+const (
+	DefaultSegmentSize        = 800
+	DefaultSegmentParallelism = 4
+)
+
+//DataSourcePolicy configures how objects of a data source are cached, zero values use engine defaults
+type DataSourcePolicy struct {
+	//Expire is the TTL of entries when BatchGet doesn't set one
+	Expire time.Duration
+	//MaxExpire limits TTL of entries, including entries saved without expiration
+	MaxExpire time.Duration
+	//SegmentSize is the max number of ids in a QueryByIDs, DefaultSegmentSize if it's 0
+	SegmentSize int
+	//SegmentParallelism is the max number of segments queried at a time, DefaultSegmentParallelism if it's 0
+	SegmentParallelism int
+	//Codec encodes saved entries, entries of every registered codec can be read
+	Codec codec.ICodec
+	//CompressThreshold overrides the threshold of SetCompressThreshold, < 0 disables compression
+	CompressThreshold int
+	//NegativeExpire is the TTL of tombstones, tombstones are disabled if it's 0
+	NegativeExpire time.Duration
+	//Disabled makes objects read from the data source directly
+	Disabled bool
+	//DisableRelated stops saving related ids, objects aren't cleaned when objects they embed change
+	DisableRelated bool
+	//ExpireCalculator overrides the expire calculator of PassiveRefresher
+	ExpireCalculator expirecalculator.IExpireCalculator
+	//DoubleDeleteDelay is DefaultDoubleDeleteDelay if it's 0, < 0 disables the second delete
+	DoubleDeleteDelay time.Duration
+	//MaxCleanDepth is DefaultMaxCleanDepth if it's 0, < 0 cleans no dependent objects
+	MaxCleanDepth int
+}
+
+//AddDataSourceWithPolicy registers querier like AddDataSource and sets its policy
+func (c *CacheEngine) AddDataSourceWithPolicy(ctx context.Context, querier IDataSource, policy *DataSourcePolicy) {
+	c.dataSources.Set(querier)
+	c.SetDataSourcePolicy(ctx, querier.Name(), policy)
+}
+
+//SetDataSourcePolicy replaces the policy of the data source, it can be set before the data source is added
+func (c *CacheEngine) SetDataSourcePolicy(ctx context.Context, dataSourceName string, policy *DataSourcePolicy) {
+	copied := *policy
+	c.dataSources.SetPolicy(dataSourceName, &copied)
+}
+
+//DataSourcePolicy returns a copy of the policy of the data source
+func (c *CacheEngine) DataSourcePolicy(dataSourceName string) DataSourcePolicy {
+	return *c.policy(dataSourceName)
+}
+
+//policy returns the policy of the data source, it mustn't be modified
+func (c *CacheEngine) policy(dataSourceName string) *DataSourcePolicy {
+	return c.dataSources.Policy(dataSourceName)
+}
+
+//enabled reports whether objects of the data source are cached
+func (c *CacheEngine) enabled(dataSourceName string) bool {
+	return c.open && !c.policy(dataSourceName).Disabled
+}
+
+//entryTTL returns the TTL of entries saved by BatchGet with expireTime
+func (c *CacheEngine) entryTTL(dataSourceName string, expireTime time.Duration) time.Duration {
+	policy := c.policy(dataSourceName)
+	ttl := c.expireTime
+	if policy.Expire > 0 {
+		ttl = policy.Expire
+	}
+	if expireTime > 0 {
+		ttl = expireTime
+	}
+	if expireTime == InfiniteExpire {
+		ttl = 0
+	}
+	if policy.MaxExpire > 0 && (ttl <= 0 || ttl > policy.MaxExpire) {
+		ttl = policy.MaxExpire
+	}
+	return ttl
+}
+
+func (c *CacheEngine) segmentSize(dataSourceName string) int {
+	size := c.policy(dataSourceName).SegmentSize
+	if size <= 0 {
+		return DefaultSegmentSize
+	}
+	return size
+}
+
+func (c *CacheEngine) segmentParallelism(dataSourceName string) int {
+	parallelism := c.policy(dataSourceName).SegmentParallelism
+	if parallelism <= 0 {
+		return DefaultSegmentParallelism
+	}
+	return parallelism
+}
+
+func (c *CacheEngine) getCodec(dataSourceName string) codec.ICodec {
+	objCodec := c.policy(dataSourceName).Codec
+	if objCodec == nil {
+		return defaultCodec
+	}
+	return objCodec
+}
+
+func (c *CacheEngine) getCompressThreshold(dataSourceName string) int {
+	threshold := c.policy(dataSourceName).CompressThreshold
+	if threshold == 0 {
+		return c.compressThreshold
+	}
+	return threshold
+}
+
+func (c *CacheEngine) getNegativeExpire(dataSourceName string) time.Duration {
+	return c.policy(dataSourceName).NegativeExpire
+}
+
+func (c *CacheEngine) getDoubleDeleteDelay(dataSourceName string) time.Duration {
+	delay := c.policy(dataSourceName).DoubleDeleteDelay
+	if delay == 0 {
+		return DefaultDoubleDeleteDelay
+	}
+	return delay
+}
+
+func (c *CacheEngine) getMaxCleanDepth(dataSourceName string) int {
+	depth := c.policy(dataSourceName).MaxCleanDepth
+	if depth == 0 {
+		return DefaultMaxCleanDepth
+	}
+	if depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+//SetCodec sets the codec of entries saved for the data source, entries of every registered codec can be read
+func (c *CacheEngine) SetCodec(ctx context.Context, dataSourceName string, objCodec codec.ICodec) {
+	c.dataSources.UpdatePolicy(dataSourceName, func(policy *DataSourcePolicy) {
+		policy.Codec = objCodec
+	})
+}
+
+//SetNegativeExpire enables tombstones for ids the data source doesn't return,
+//a tombstone is a cache hit without object until it expires or the id is cleaned, ttl <= 0 disables it
+func (c *CacheEngine) SetNegativeExpire(ctx context.Context, dataSourceName string, ttl time.Duration) {
+	c.dataSources.UpdatePolicy(dataSourceName, func(policy *DataSourcePolicy) {
+		policy.NegativeExpire = ttl
+	})
+}
+
+//SetDoubleDeleteDelay sets the delay of the second delete for the data source, delay <= 0 disables it
+func (c *CacheEngine) SetDoubleDeleteDelay(ctx context.Context, dataSourceName string, delay time.Duration) {
+	if delay <= 0 {
+		delay = -1
+	}
+	c.dataSources.UpdatePolicy(dataSourceName, func(policy *DataSourcePolicy) {
+		policy.DoubleDeleteDelay = delay
+	})
+}
+
+//SetMaxCleanDepth sets how many levels of dependent objects are cleaned with objects of the data source
+func (c *CacheEngine) SetMaxCleanDepth(ctx context.Context, dataSourceName string, depth int) {
+	if depth <= 0 {
+		depth = -1
+	}
+	c.dataSources.UpdatePolicy(dataSourceName, func(policy *DataSourcePolicy) {
+		policy.MaxCleanDepth = depth
+	})
+}
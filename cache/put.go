@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/tracecontext"
+)
+
+//Put writes objects updated by the caller into the cache, expireTime works as in BatchGet.
+//Objects depending on them are cleaned like Clean, including the second delete,
+//but the objects written are kept, so that the next read is a hit
+func (c *CacheEngine) Put(ctx context.Context, querierName string, objs []Object, expireTime time.Duration) error {
+	querier, exists := c.dataSources.Get(querierName)
+	if !exists {
+		log.Error(ctx, "unknown data source",
+			log.String("querierName", querierName),
+			log.Strings("dataSources", c.dataSources.Names()))
+		return ErrUnknownQuerier
+	}
+	ids := make([]string, len(objs))
+	for i := range objs {
+		ids[i] = objs[i].StringID()
+	}
+	return c.put(ctx, querier, ids, objs, expireTime)
+}
+
+//Refresh reloads ids from the data source and overwrites their entries like Put,
+//ids the data source doesn't return are cleaned
+func (c *CacheEngine) Refresh(ctx context.Context, querierName string, ids []string) error {
+	querier, exists := c.dataSources.Get(querierName)
+	if !exists {
+		log.Error(ctx, "unknown data source",
+			log.String("querierName", querierName),
+			log.Strings("dataSources", c.dataSources.Names()))
+		return ErrUnknownQuerier
+	}
+	if !c.open {
+		return nil
+	}
+	//a coalesced load may have started before the update, load ids on our own.
+	//A read-through load racing with Refresh saves only if its lease is still in the entry,
+	//the objects written here replace the lease, so that the stale object is dropped when leases are enabled
+	objs, err := c.segmentGetFromDB(ctx, querier, ids)
+	failures, err := partialFailures(err)
+	if err != nil {
+		log.Error(ctx, "segmentGetFromDB failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
+		return err
+	}
+	//entries of ids failed are left as they are
+	err = c.put(ctx, querier, withoutFailures(ids, failures), objs, EngineExpire)
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return &PartialResultError{DataSourceName: querierName, Failures: failures}
+	}
+	return nil
+}
+
+//put writes objs and cleans objects depending on ids, entries of ids not in objs are cleaned too
+func (c *CacheEngine) put(ctx context.Context, querier IDataSource, ids []string, objs []Object, expireTime time.Duration) error {
+	if !c.open {
+		return nil
+	}
+	querierName := querier.Name()
+	kept := make(map[string]bool, len(objs))
+	if c.enabled(querierName) {
+		err := c.saveCache(ctx, querier, objs, expireTime, nil)
+		if err != nil {
+			return err
+		}
+		for i := range objs {
+			kept[objs[i].StringID()] = true
+		}
+	}
+
+	_, err := c.cleanExcept(ctx, querierName, ids, kept)
+	if err != nil {
+		log.Error(ctx, "cleanExcept failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
+		return err
+	}
+	delay := c.getDoubleDeleteDelay(querierName)
+	if delay > 0 {
+		//the second delete runs after the request, don't bind it to ctx
+		ctx2 := context.Background()
+		badaCtx, ok := tracecontext.GetTraceContext(ctx)
+		if ok {
+			badaCtx.EmbedIntoContext(ctx2)
+		}
+		c.deleter.schedule(delay, func() {
+			_, err := c.cleanExcept(ctx2, querierName, ids, kept)
+			if err != nil {
+				log.Error(ctx2, "cleanExcept failed",
+					log.Err(err),
+					log.String("querierName", querierName),
+					log.Strings("ids", ids))
+			}
+		})
+	}
+	return nil
+}
@@ -4,6 +4,20 @@ import (
 	"reflect"
 )
 
+var objectType = reflect.TypeOf((*Object)(nil)).Elem()
+
+//objectSlice is the result container filled by the engine
+type objectSlice interface {
+	//Decode unmarshals data into a new element
+	Decode(data []byte, unmarshal func(data []byte, v interface{}) error) (Object, error)
+	SetSlice(o []Object)
+	Iterator(do func(o Object))
+	Append(o ...Object)
+	Len() int
+	//Value returns the underlying slice
+	Value() interface{}
+}
+
 type ReflectObjectSlice struct {
 	ptr      reflect.Value
 	slice    reflect.Value
@@ -14,6 +28,15 @@ func (r *ReflectObjectSlice) NewElement() Object {
 	return reflect.New(r.elemType).Interface().(Object)
 }
 
+func (r *ReflectObjectSlice) Decode(data []byte, unmarshal func(data []byte, v interface{}) error) (Object, error) {
+	obj := r.NewElement()
+	err := unmarshal(data, obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
 func (r *ReflectObjectSlice) SetSlice(o []Object) {
 	r.ptr.Elem().Set(reflect.MakeSlice(r.ptr.Type().Elem(), 0, r.ptr.Elem().Cap()))
 	for i := range o {
@@ -29,23 +52,44 @@ func (r *ReflectObjectSlice) Iterator(do func(o Object)) {
 }
 
 func (r *ReflectObjectSlice) Append(o ...Object) {
+	sliceElemType := r.slice.Type().Elem()
 	for i := range o {
-		r.slice.Set(reflect.Append(r.slice, reflect.ValueOf(o[i])))
+		value := reflect.ValueOf(o[i])
+		//elements are created as pointers, dereference them for slices of structs
+		if !value.Type().AssignableTo(sliceElemType) && value.Kind() == reflect.Ptr {
+			value = value.Elem()
+		}
+		r.slice.Set(reflect.Append(r.slice, value))
 	}
 }
 
+func (r *ReflectObjectSlice) Len() int {
+	return r.slice.Len()
+}
+
+func (r *ReflectObjectSlice) Value() interface{} {
+	return r.slice.Interface()
+}
+
+//NewReflectObjectSlice wraps o, which must be a pointer to a slice of structs or struct pointers implementing Object
 func NewReflectObjectSlice(o interface{}) (*ReflectObjectSlice, error) {
-	switch reflect.TypeOf(o).Kind() {
-	case reflect.Ptr:
-		ptr := reflect.ValueOf(o)
-		s := ptr.Elem()
-		pt := reflect.TypeOf(o).Elem().Elem()
-
-		if pt.Kind() != reflect.Struct {
-			pt = pt.Elem()
-		}
-		return &ReflectObjectSlice{ptr: ptr, slice: s, elemType: pt}, nil
-	default:
+	t := reflect.TypeOf(o)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Slice {
+		return nil, ErrInvalidObjectSlice
+	}
+	ptr := reflect.ValueOf(o)
+	if ptr.IsNil() {
+		return nil, ErrInvalidObjectSlice
+	}
+	sliceElemType := t.Elem().Elem()
+	pt := sliceElemType
+	if pt.Kind() == reflect.Ptr {
+		pt = pt.Elem()
+	}
+	if pt.Kind() != reflect.Struct ||
+		!sliceElemType.Implements(objectType) ||
+		!reflect.PtrTo(pt).Implements(objectType) {
 		return nil, ErrInvalidObjectSlice
 	}
+	return &ReflectObjectSlice{ptr: ptr, slice: ptr.Elem(), elemType: pt}, nil
 }
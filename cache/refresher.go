@@ -2,14 +2,10 @@ package cache
 
 import (
 	"context"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/KL-Engineering/common-log/log"
-	"github.com/KL-Engineering/kidsloop-cache/constant"
-	"github.com/KL-Engineering/ro"
-	"github.com/go-redis/redis/v8"
 )
 
 const (
@@ -41,19 +37,13 @@ func (c *CacheRefresher) BatchGet(ctx context.Context, dataSourceName string, id
 			log.Strings("ids", ids))
 		return err
 	}
-	if !c.engine.open {
+	if !c.engine.enabled(dataSourceName) {
 		return nil
 	}
 
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return err
-	}
-
 	//if need refresh, enqueue it
 	if refresh {
-		c.enqueueData(ctx, client, dataSourceName, ids)
+		c.enqueueData(ctx, dataSourceName, ids)
 	}
 	return nil
 }
@@ -64,22 +54,17 @@ func (c *CacheRefresher) Stop() {
 
 func (c *CacheRefresher) Start() {
 	ctx := context.Background()
-	client, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "GetRedis failed", log.Err(err))
-		return
-	}
 	c.start = true
 	go func() {
 		//sleep 30 seconds
 		for c.start {
 			time.Sleep(c.refreshInterval)
-			c.doRefresh(ctx, client)
+			c.doRefresh(ctx)
 		}
 	}()
 }
-func (c *CacheRefresher) doRefresh(ctx context.Context, client *redis.Client) {
-	querierMap, err := c.dequeueData(ctx, client)
+func (c *CacheRefresher) doRefresh(ctx context.Context) {
+	querierMap, err := c.dequeueData(ctx)
 	if err != nil {
 		log.Error(ctx, "dequeueData failed",
 			log.Err(err))
@@ -88,11 +73,11 @@ func (c *CacheRefresher) doRefresh(ctx context.Context, client *redis.Client) {
 
 	//enqueue
 	for querierName, ids := range querierMap {
-		querier, exists := c.engine.querierMap[querierName]
+		querier, exists := c.engine.dataSources.Get(querierName)
 		if !exists {
-			log.Error(ctx, "GetRedis failed",
+			log.Error(ctx, "unknown data source",
 				log.String("querierName", querierName),
-				log.Any("querierMap", c.engine.querierMap))
+				log.Strings("dataSources", c.engine.dataSources.Names()))
 			continue
 		}
 		objs, err := querier.QueryByIDs(ctx, ids)
@@ -104,40 +89,44 @@ func (c *CacheRefresher) doRefresh(ctx context.Context, client *redis.Client) {
 			continue
 		}
 		//update cache
-		c.engine.saveCache(ctx, querier, client, objs, 0)
+		c.engine.saveCache(ctx, querier, objs, 0, nil)
 
 		//redo enqueue for next refresh
-		c.enqueueData(ctx, client, querierName, ids)
+		c.enqueueData(ctx, querierName, ids)
 	}
 }
 
-func (c *CacheRefresher) enqueueData(ctx context.Context, client *redis.Client, querierName string, ids []string) {
-	values := make([]interface{}, len(ids))
+func (c *CacheRefresher) enqueueData(ctx context.Context, querierName string, ids []string) {
+	values := make([]string, len(ids))
 	for i := range ids {
-		values[i] = querierName + constant.KlcIDSeparator + ids[i]
+		values[i] = c.engine.keyBuilder.RefreshMember(querierName, ids[i])
+	}
+	err := c.engine.storage.SAdd(ctx, c.engine.keyBuilder.RefreshQueueKey(), values, 0)
+	if err != nil {
+		log.Error(ctx, "enqueue refresh data failed",
+			log.Err(err),
+			log.String("querierName", querierName),
+			log.Strings("ids", ids))
 	}
-	client.SAdd(ctx, constant.KlcRefreshPrefix, values...)
 }
 
-func (c *CacheRefresher) dequeueData(ctx context.Context, client *redis.Client) (map[string][]string, error) {
-	data, err := client.SPopN(ctx, constant.KlcRefreshPrefix, c.refreshSize).Result()
+func (c *CacheRefresher) dequeueData(ctx context.Context) (map[string][]string, error) {
+	data, err := c.engine.storage.SPopN(ctx, c.engine.keyBuilder.RefreshQueueKey(), c.refreshSize)
 	if err != nil {
-		log.Error(ctx, "pop redis set failed",
+		log.Error(ctx, "pop refresh set failed",
 			log.Err(err))
 		return nil, err
 	}
 	result := make(map[string][]string)
 	for i := range data {
-		keyPairs := strings.Split(data[i], constant.KlcIDSeparator)
-		if len(keyPairs) != 2 {
+		querierName, id, ok := c.engine.keyBuilder.ParseRefreshMember(data[i])
+		if !ok {
 			log.Error(ctx, "pop redis set failed",
 				log.Err(err),
 				log.String("data", data[i]),
 				log.Strings("all data", data))
 			continue
 		}
-		querierName := keyPairs[0]
-		id := keyPairs[1]
 
 		querierData := result[querierName]
 		if querierData == nil {
@@ -156,11 +145,7 @@ var (
 
 func GetCacheRefresher() *CacheRefresher {
 	_cacheRefresherEngineOnce.Do(func() {
-		_cacheRefresherEngine = &CacheRefresher{
-			engine:          GetCacheEngine(),
-			refreshSize:     defaultRefreshSize,
-			refreshInterval: defaultRefreshInterval,
-		}
+		_cacheRefresherEngine = NewCacheRefresher(GetCacheEngine())
 	})
 	return _cacheRefresherEngine
 }
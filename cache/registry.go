@@ -0,0 +1,286 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/KL-Engineering/common-log/log"
+)
+
+var (
+	ErrDuplicateDataSource = errors.New("duplicate data source")
+)
+
+//IRelatedDataSource declares data sources whose objects are embedded in objects of the data source,
+//the declaration is checked by ValidateDataSources
+type IRelatedDataSource interface {
+	RelatedDataSources() []string
+}
+
+//ValidationError reports relations declared by IRelatedDataSource which can't be resolved
+type ValidationError struct {
+	//UnknownRelations is map[dataSourceName][unknown related data source names]
+	UnknownRelations map[string][]string
+	//Cycles are data source names in a cycle of relations, the first name is repeated at the end
+	Cycles [][]string
+}
+
+func (v *ValidationError) Error() string {
+	messages := make([]string, 0)
+	names := make([]string, 0, len(v.UnknownRelations))
+	for name := range v.UnknownRelations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%v relates to unknown data sources %v", name, v.UnknownRelations[name]))
+	}
+	for i := range v.Cycles {
+		messages = append(messages, "cyclic relation "+strings.Join(v.Cycles[i], " -> "))
+	}
+	return "invalid data sources: " + strings.Join(messages, "; ")
+}
+
+//dataSourceRegistry is safe for concurrent use
+type dataSourceRegistry struct {
+	sync.RWMutex
+	sources  map[string]IDataSource
+	policies map[string]*DataSourcePolicy
+}
+
+var defaultPolicy = new(DataSourcePolicy)
+
+//Policy returns the policy of name, a policy is replaced instead of modified
+func (r *dataSourceRegistry) Policy(name string) *DataSourcePolicy {
+	r.RLock()
+	defer r.RUnlock()
+	policy, exists := r.policies[name]
+	if !exists {
+		return defaultPolicy
+	}
+	return policy
+}
+
+func (r *dataSourceRegistry) SetPolicy(name string, policy *DataSourcePolicy) {
+	r.Lock()
+	defer r.Unlock()
+	r.policies[name] = policy
+}
+
+//UpdatePolicy replaces the policy of name with a copy modified by update
+func (r *dataSourceRegistry) UpdatePolicy(name string, update func(policy *DataSourcePolicy)) {
+	r.Lock()
+	defer r.Unlock()
+	policy := new(DataSourcePolicy)
+	current, exists := r.policies[name]
+	if exists {
+		*policy = *current
+	}
+	update(policy)
+	r.policies[name] = policy
+}
+
+func (r *dataSourceRegistry) Get(name string) (IDataSource, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	source, exists := r.sources[name]
+	return source, exists
+}
+
+func (r *dataSourceRegistry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *dataSourceRegistry) Set(source IDataSource) {
+	r.Lock()
+	defer r.Unlock()
+	r.sources[source.Name()] = source
+}
+
+func (r *dataSourceRegistry) Register(source IDataSource) error {
+	r.Lock()
+	defer r.Unlock()
+	_, exists := r.sources[source.Name()]
+	if exists {
+		return ErrDuplicateDataSource
+	}
+	r.sources[source.Name()] = source
+	return nil
+}
+
+func (r *dataSourceRegistry) Replace(source IDataSource) error {
+	r.Lock()
+	defer r.Unlock()
+	_, exists := r.sources[source.Name()]
+	if !exists {
+		return ErrUnknownQuerier
+	}
+	r.sources[source.Name()] = source
+	return nil
+}
+
+func (r *dataSourceRegistry) Unregister(name string) error {
+	r.Lock()
+	defer r.Unlock()
+	_, exists := r.sources[name]
+	if !exists {
+		return ErrUnknownQuerier
+	}
+	delete(r.sources, name)
+	return nil
+}
+
+//relations returns map[dataSourceName][related data source names] declared by IRelatedDataSource
+func (r *dataSourceRegistry) relations() map[string][]string {
+	r.RLock()
+	defer r.RUnlock()
+	relations := make(map[string][]string, len(r.sources))
+	for name, source := range r.sources {
+		related, ok := source.(IRelatedDataSource)
+		if !ok {
+			continue
+		}
+		relations[name] = related.RelatedDataSources()
+	}
+	return relations
+}
+
+//embedders returns map[dataSourceName][data sources which may embed its objects],
+//data sources declaring no relations may embed objects of every data source
+func (r *dataSourceRegistry) embedders() map[string][]string {
+	r.RLock()
+	defer r.RUnlock()
+	embedders := make(map[string][]string, len(r.sources))
+	for name, source := range r.sources {
+		var relatedNames []string
+		related, ok := source.(IRelatedDataSource)
+		if ok {
+			relatedNames = related.RelatedDataSources()
+		}
+		if len(relatedNames) < 1 {
+			for embedded := range r.sources {
+				embedders[embedded] = append(embedders[embedded], name)
+			}
+			continue
+		}
+		for i := range relatedNames {
+			embedders[relatedNames[i]] = append(embedders[relatedNames[i]], name)
+		}
+	}
+	return embedders
+}
+
+func newDataSourceRegistry() *dataSourceRegistry {
+	return &dataSourceRegistry{
+		sources:  make(map[string]IDataSource),
+		policies: make(map[string]*DataSourcePolicy),
+	}
+}
+
+//RegisterDataSource adds a data source, it fails if the name is registered
+func (c *CacheEngine) RegisterDataSource(ctx context.Context, querier IDataSource) error {
+	err := c.dataSources.Register(querier)
+	if err != nil {
+		log.Error(ctx, "RegisterDataSource failed", log.Err(err), log.String("querierName", querier.Name()))
+		return err
+	}
+	return nil
+}
+
+//ReplaceDataSource replaces a registered data source, entries cached by the old one are kept
+func (c *CacheEngine) ReplaceDataSource(ctx context.Context, querier IDataSource) error {
+	err := c.dataSources.Replace(querier)
+	if err != nil {
+		log.Error(ctx, "ReplaceDataSource failed", log.Err(err), log.String("querierName", querier.Name()))
+		return err
+	}
+	return nil
+}
+
+//UnregisterDataSource removes a data source, BatchGet and Clean of it fail with ErrUnknownQuerier afterwards
+func (c *CacheEngine) UnregisterDataSource(ctx context.Context, querierName string) error {
+	err := c.dataSources.Unregister(querierName)
+	if err != nil {
+		log.Error(ctx, "UnregisterDataSource failed", log.Err(err), log.String("querierName", querierName))
+		return err
+	}
+	return nil
+}
+
+//ValidateDataSources checks relations declared by data sources implementing IRelatedDataSource,
+//it returns a *ValidationError for relations to unregistered data sources or cyclic relations
+func (c *CacheEngine) ValidateDataSources(ctx context.Context) error {
+	relations := c.dataSources.relations()
+	result := &ValidationError{UnknownRelations: make(map[string][]string)}
+	for name, relatedNames := range relations {
+		for i := range relatedNames {
+			_, exists := c.dataSources.Get(relatedNames[i])
+			if !exists {
+				result.UnknownRelations[name] = append(result.UnknownRelations[name], relatedNames[i])
+			}
+		}
+	}
+	result.Cycles = findCycles(relations)
+	if len(result.UnknownRelations) == 0 && len(result.Cycles) == 0 {
+		return nil
+	}
+	log.Error(ctx, "ValidateDataSources failed", log.Err(result))
+	return result
+}
+
+//findCycles finds a cycle for every back edge in a depth first search of relations
+func findCycles(relations map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	names := make([]string, 0, len(relations))
+	for name := range relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	states := make(map[string]int)
+	path := make([]string, 0)
+	cycles := make([][]string, 0)
+	var visit func(name string)
+	visit = func(name string) {
+		states[name] = visiting
+		path = append(path, name)
+		for _, related := range relations[name] {
+			switch states[related] {
+			case unvisited:
+				visit(related)
+			case visiting:
+				//the cycle starts where related is on the path
+				for i := range path {
+					if path[i] == related {
+						cycle := append(append([]string{}, path[i:]...), related)
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		states[name] = visited
+	}
+	for _, name := range names {
+		if states[name] == unvisited {
+			visit(name)
+		}
+	}
+	return cycles
+}
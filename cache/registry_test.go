@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type registryDataSource struct {
+	name    string
+	related []string
+}
+
+func (s *registryDataSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]Object, error) {
+	return nil, nil
+}
+
+func (s *registryDataSource) Name() string {
+	return s.name
+}
+
+func (s *registryDataSource) RelatedDataSources() []string {
+	return s.related
+}
+
+func TestRegisterDataSource(t *testing.T) {
+	ctx := context.Background()
+	engine := New()
+	err := engine.RegisterDataSource(ctx, &registryDataSource{name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.RegisterDataSource(ctx, &registryDataSource{name: "a"})
+	if err != ErrDuplicateDataSource {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = engine.ReplaceDataSource(ctx, &registryDataSource{name: "b"})
+	if err != ErrUnknownQuerier {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	replaced := &registryDataSource{name: "a", related: []string{"b"}}
+	err = engine.ReplaceDataSource(ctx, replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _ := engine.dataSources.Get("a")
+	if source != replaced {
+		t.Fatal("data source should be replaced")
+	}
+	err = engine.UnregisterDataSource(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exists := engine.dataSources.Get("a")
+	if exists || engine.UnregisterDataSource(ctx, "a") != ErrUnknownQuerier {
+		t.Fatal("data source should be unregistered")
+	}
+}
+
+func TestValidateDataSources(t *testing.T) {
+	ctx := context.Background()
+	engine := New(WithDataSources(
+		&registryDataSource{name: "a", related: []string{"b", "d"}},
+		&registryDataSource{name: "b", related: []string{"d"}},
+		&registryDataSource{name: "d", related: []string{"e"}},
+		&registryDataSource{name: "e"},
+	))
+	err := engine.ValidateDataSources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.AddDataSource(ctx, &registryDataSource{name: "e", related: []string{"a", "x"}})
+	err = engine.ValidateDataSources(ctx)
+	validationErr := new(ValidationError)
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(validationErr.UnknownRelations["e"]) != 1 || validationErr.UnknownRelations["e"][0] != "x" {
+		t.Fatalf("unexpected unknown relations: %v", validationErr.UnknownRelations)
+	}
+	if len(validationErr.Cycles) < 1 {
+		t.Fatalf("cycles should be found: %v", err)
+	}
+	cycle := validationErr.Cycles[0]
+	if cycle[0] != cycle[len(cycle)-1] {
+		t.Fatalf("unexpected cycle: %v", cycle)
+	}
+}
@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	//DefaultDataSourceTimeout bounds loads from data sources unless another timeout is set
+	DefaultDataSourceTimeout = time.Second * 30
+)
+
+//SetCacheTimeout limits every cache read of a request and the cache writes after it,
+//a read exceeding its timeout falls back to the data source, timeout <= 0 only follows the deadline of ctx
+func (c *CacheEngine) SetCacheTimeout(ctx context.Context, readTimeout time.Duration, writeTimeout time.Duration) {
+	c.cacheReadTimeout = readTimeout
+	c.cacheWriteTimeout = writeTimeout
+}
+
+//SetDataSourceTimeout limits every load from data sources, it's DefaultDataSourceTimeout by default.
+//Loads by ids are shared by concurrent callers and don't follow their deadlines, so the timeout is the only bound of a hung load,
+//timeout <= 0 removes the bound and only condition queries follow the deadline of ctx
+func (c *CacheEngine) SetDataSourceTimeout(ctx context.Context, timeout time.Duration) {
+	c.dataSourceTimeout = timeout
+}
+
+//withTimeout returns ctx limited by timeout, the deadline of ctx is kept if it's earlier
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
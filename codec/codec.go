@@ -0,0 +1,128 @@
+package codec
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	//headerMarker starts every value with a header, it never starts a JSON document
+	headerMarker = 0xFF
+	headerSize   = 2
+
+	formatMask = 0x1F
+	flagMask   = 0xE0
+
+	flagGzip      = 0x80
+	flagTombstone = 0x40
+	flagLease     = 0x20
+)
+
+const (
+	FormatJSON byte = 0
+	FormatGob  byte = 1
+)
+
+var (
+	ErrUnknownFlag   = errors.New("unknown codec flag")
+	ErrUnknownFormat = errors.New("unknown codec format")
+	ErrInvalidFormat = errors.New("invalid codec format")
+	ErrInvalidHeader = errors.New("invalid codec header")
+)
+
+type ICodec interface {
+	Name() string
+	//Format identifies the codec in stored values, it must be unique and in [0, 31]
+	Format() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	_codecs      = make(map[byte]ICodec)
+	_codecsMutex sync.RWMutex
+)
+
+//Register makes a codec available for decoding, built-in codecs are registered already
+func Register(c ICodec) error {
+	if c.Format() > formatMask {
+		return ErrInvalidFormat
+	}
+	_codecsMutex.Lock()
+	defer _codecsMutex.Unlock()
+	_codecs[c.Format()] = c
+	return nil
+}
+
+func GetCodec(format byte) (ICodec, error) {
+	_codecsMutex.RLock()
+	defer _codecsMutex.RUnlock()
+	c, exists := _codecs[format]
+	if !exists {
+		return nil, ErrUnknownFormat
+	}
+	return c, nil
+}
+
+//Encode marshals v with c, values of JSON codec are stored without header
+//so they can be read by engines unaware of codecs
+func Encode(c ICodec, v interface{}) ([]byte, error) {
+	payload, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.Format() == FormatJSON {
+		return payload, nil
+	}
+	return joinHeader(c.Format(), 0, payload), nil
+}
+
+//Decode unmarshals data written by Encode with any registered codec,
+//data without header is treated as JSON
+func Decode(data []byte, v interface{}) error {
+	format, flags, payload, err := splitHeader(data)
+	if err != nil {
+		return err
+	}
+	switch flags {
+	case 0:
+	case flagGzip:
+		payload, err = gunzip(payload)
+		if err != nil {
+			return err
+		}
+	case flagTombstone:
+		return ErrTombstone
+	case flagLease:
+		return ErrLease
+	default:
+		return ErrUnknownFlag
+	}
+	c, err := GetCodec(format)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(payload, v)
+}
+
+//splitHeader returns format, flags and payload of data
+func splitHeader(data []byte) (byte, byte, []byte, error) {
+	if len(data) < 1 || data[0] != headerMarker {
+		return FormatJSON, 0, data, nil
+	}
+	if len(data) < headerSize {
+		return 0, 0, nil, ErrInvalidHeader
+	}
+	return data[1] & formatMask, data[1] & flagMask, data[headerSize:], nil
+}
+
+func joinHeader(format byte, flags byte, payload []byte) []byte {
+	data := make([]byte, 0, len(payload)+headerSize)
+	data = append(data, headerMarker, (format&formatMask)|(flags&flagMask))
+	return append(data, payload...)
+}
+
+func init() {
+	_ = Register(new(JSONCodec))
+	_ = Register(new(GobCodec))
+}
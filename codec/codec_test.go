@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+type codecRecord struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Inner *codecRecord
+}
+
+func TestEncodeDecode(t *testing.T) {
+	codecs := []ICodec{new(JSONCodec), new(GobCodec)}
+	for i := range codecs {
+		data, err := Encode(codecs[i], &codecRecord{ID: "1", Title: "t", Inner: &codecRecord{ID: "2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//decode into a nil pointer like typed results do
+		var record *codecRecord
+		err = Decode(data, &record)
+		if err != nil {
+			t.Fatalf("%v: %v", codecs[i].Name(), err)
+		}
+		if record.ID != "1" || record.Title != "t" || record.Inner.ID != "2" {
+			t.Fatalf("%v: unexpected record %#v", codecs[i].Name(), record)
+		}
+	}
+}
+
+func TestDecodeLegacyJSON(t *testing.T) {
+	record := new(codecRecord)
+	err := Decode([]byte(`{"id":"1","title":"t"}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ID != "1" || record.Title != "t" {
+		t.Fatalf("unexpected record %#v", record)
+	}
+}
+
+func TestDecodeUnknownFormat(t *testing.T) {
+	err := Decode([]byte{headerMarker, 30, 'x'}, new(codecRecord))
+	if err != ErrUnknownFormat {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	title := string(bytes.Repeat([]byte("lesson plan "), 100))
+	codecs := []ICodec{new(JSONCodec), new(GobCodec)}
+	for i := range codecs {
+		data, err := Encode(codecs[i], &codecRecord{ID: "1", Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := Compress(data, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Compressed(compressed) || len(compressed) >= len(data) {
+			t.Fatalf("%v: data should be compressed, %v >= %v", codecs[i].Name(), len(compressed), len(data))
+		}
+		record := new(codecRecord)
+		err = Decode(compressed, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Title != title {
+			t.Fatalf("%v: unexpected record %#v", codecs[i].Name(), record)
+		}
+	}
+
+	small, _ := Encode(new(JSONCodec), &codecRecord{ID: "1"})
+	data, _ := Compress(small, 100)
+	if Compressed(data) {
+		t.Fatal("small data should not be compressed")
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	if !IsTombstone(Tombstone()) {
+		t.Fatal("tombstone is not recognized")
+	}
+	data, _ := Encode(new(GobCodec), &codecRecord{ID: "1"})
+	if IsTombstone(data) || IsTombstone([]byte("{}")) {
+		t.Fatal("values should not be tombstones")
+	}
+	err := Decode(Tombstone(), new(codecRecord))
+	if err != ErrTombstone {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	lease := Lease([]byte("token"))
+	if !IsLease(lease) || IsTombstone(lease) || IsLease(Tombstone()) {
+		t.Fatal("lease is not recognized")
+	}
+	err := Decode(lease, new(codecRecord))
+	if err != ErrLease {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
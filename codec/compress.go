@@ -0,0 +1,52 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+//Compress gzips data written by Encode when its payload is larger than threshold,
+//data is returned as is if compression doesn't make it smaller
+func Compress(data []byte, threshold int) ([]byte, error) {
+	if threshold <= 0 || len(data) <= threshold {
+		return data, nil
+	}
+	format, flags, payload, err := splitHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagGzip != 0 {
+		return data, nil
+	}
+
+	buf := new(bytes.Buffer)
+	writer := gzip.NewWriter(buf)
+	_, err = writer.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len()+headerSize >= len(data) {
+		return data, nil
+	}
+	return joinHeader(format, flags|flagGzip, buf.Bytes()), nil
+}
+
+//Compressed reports whether data is compressed by Compress
+func Compressed(data []byte) bool {
+	_, flags, _, err := splitHeader(data)
+	return err == nil && flags&flagGzip != 0
+}
+
+func gunzip(payload []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,31 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+//GobCodec is a binary codec, only exported fields are stored
+type GobCodec struct {
+}
+
+func (g *GobCodec) Name() string {
+	return "gob"
+}
+
+func (g *GobCodec) Format() byte {
+	return FormatGob
+}
+
+func (g *GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,22 @@
+package codec
+
+import "encoding/json"
+
+type JSONCodec struct {
+}
+
+func (j *JSONCodec) Name() string {
+	return "json"
+}
+
+func (j *JSONCodec) Format() byte {
+	return FormatJSON
+}
+
+func (j *JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (j *JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
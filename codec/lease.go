@@ -0,0 +1,18 @@
+package codec
+
+import "errors"
+
+var (
+	ErrLease = errors.New("value is a lease")
+)
+
+//Lease returns the placeholder saved while the owner of token loads the value
+func Lease(token []byte) []byte {
+	return joinHeader(FormatJSON, flagLease, token)
+}
+
+//IsLease reports whether data is written by Lease
+func IsLease(data []byte) bool {
+	_, flags, _, err := splitHeader(data)
+	return err == nil && flags == flagLease
+}
@@ -0,0 +1,18 @@
+package codec
+
+import "errors"
+
+var (
+	ErrTombstone = errors.New("value is a tombstone")
+)
+
+//Tombstone returns the value saved for ids which don't exist in the data source
+func Tombstone() []byte {
+	return joinHeader(FormatJSON, flagTombstone, nil)
+}
+
+//IsTombstone reports whether data is written by Tombstone
+func IsTombstone(data []byte) bool {
+	_, flags, _, err := splitHeader(data)
+	return err == nil && flags == flagTombstone
+}
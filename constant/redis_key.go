@@ -1,8 +1,9 @@
 package constant
 
 const (
-	KlcEntryPrefix   = "klc:cache:entry:"
-	KlcRelatedPrefix = "klc:cache:related:"
+	KlcEntryPrefix    = "klc:cache:entry:"
+	KlcRelatedPrefix  = "klc:cache:related:"
+	KlcLoadLockPrefix = "klc:cache:lock:"
 
 	KlcGlobalFeedbackPrefix = "klc:cache:expirecalculator:global"
 	KlcGroupFeedbackPrefix  = "klc:cache:expirecalculator:group:"
@@ -12,6 +13,11 @@ const (
 	KlcRefreshPrefix = "klc:cache:refresh"
 	KlcIDSeparator   = "-"
 
-	KlcHitCachePrefix  = "klc:cache:statistics:hit:"
+	KlcStatisticsPrefix = "klc:cache:statistics:"
+	//Deprecated: statistics keys are built by the key builder from KlcStatisticsPrefix
+	KlcHitCachePrefix = "klc:cache:statistics:hit:"
+	//Deprecated: statistics keys are built by the key builder from KlcStatisticsPrefix
 	KlcMissCachePrefix = "klc:cache:statistics:miss:"
+
+	KlcInvalidationChannel = "klc:cache:invalidation"
 )
@@ -21,9 +21,14 @@ var (
 	_calculatorOnce sync.Once
 )
 
+//NewExpireCalculator creates the default expire calculator
+func NewExpireCalculator() IExpireCalculator {
+	return new(IntegrateDerivativeTimeExpireCalculator)
+}
+
 func GetExpireCalculator() IExpireCalculator {
 	_calculatorOnce.Do(func() {
-		_calculator = new(IntegrateDerivativeTimeExpireCalculator)
+		_calculator = NewExpireCalculator()
 	})
 	return _calculator
 }
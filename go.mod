@@ -7,14 +7,14 @@ require (
 	github.com/Klasmart-Engineering/dbo v0.6.0
 	github.com/Klasmart-Engineering/ro v0.4.1
 	github.com/Klasmart-Engineering/tracecontext v0.1.0
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/jinzhu/gorm v1.9.12
 	gorm.io/driver/mysql v1.3.2
 )
 
 require (
-	github.com/cespare/xxhash/v2 v2.1.2 // indirect
-	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
@@ -0,0 +1,140 @@
+package keybuilder
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/KL-Engineering/kidsloop-cache/constant"
+)
+
+//IKeyBuilder builds every key and channel used in the storage
+type IKeyBuilder interface {
+	EntryKey(dataSourceName string, id string) string
+	RelatedKey(dataSourceName string, id string) string
+	LoadLockKey(dataSourceName string, id string) string
+	ExpireKey(dataSourceName string, id string) string
+
+	GlobalFeedbackKey() string
+	GroupFeedbackKey(dataSourceName string) string
+	IDFeedbackKey(dataSourceName string, id string) string
+
+	RefreshQueueKey() string
+	//RefreshMember builds a member of the refresh queue, ParseRefreshMember reverts it
+	RefreshMember(dataSourceName string, id string) string
+	ParseRefreshMember(member string) (string, string, bool)
+
+	//StatisticsKey builds keys of statistics, e.g. StatisticsKey("hit", "202201")
+	StatisticsKey(parts ...string) string
+	InvalidationChannel() string
+}
+
+var (
+	escaper   = strings.NewReplacer("%", "%25", ":", "%3A", "{", "%7B", "}", "%7D")
+	unescaper = strings.NewReplacer("%25", "%", "%3A", ":", "%7B", "{", "%7D", "}")
+)
+
+//Escape makes s safe as a part of keys, ':' separates parts and '{' '}' are hash tags of redis cluster
+func Escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func Unescape(s string) string {
+	return unescaper.Replace(s)
+}
+
+//KeyBuilder puts keys under Namespace and escapes data source names and ids,
+//keys of an empty Namespace are the same as old versions unless ids contain escaped characters
+type KeyBuilder struct {
+	//Namespace separates applications or environments sharing a storage, e.g. "cms:prod"
+	Namespace string
+}
+
+func (k *KeyBuilder) key(prefix string, parts ...string) string {
+	builder := new(strings.Builder)
+	if k.Namespace != "" {
+		builder.WriteString(k.Namespace)
+		builder.WriteString(":")
+	}
+	builder.WriteString(prefix)
+	for i := range parts {
+		if i > 0 {
+			builder.WriteString(":")
+		}
+		builder.WriteString(Escape(parts[i]))
+	}
+	return builder.String()
+}
+
+func (k *KeyBuilder) EntryKey(dataSourceName string, id string) string {
+	return k.key(constant.KlcEntryPrefix, dataSourceName, id)
+}
+
+func (k *KeyBuilder) RelatedKey(dataSourceName string, id string) string {
+	return k.key(constant.KlcRelatedPrefix, dataSourceName, id)
+}
+
+func (k *KeyBuilder) LoadLockKey(dataSourceName string, id string) string {
+	return k.key(constant.KlcLoadLockPrefix, dataSourceName, id)
+}
+
+func (k *KeyBuilder) ExpireKey(dataSourceName string, id string) string {
+	return k.key(constant.KlcIDExpirePrefix, dataSourceName, id)
+}
+
+func (k *KeyBuilder) GlobalFeedbackKey() string {
+	return k.key(constant.KlcGlobalFeedbackPrefix)
+}
+
+func (k *KeyBuilder) GroupFeedbackKey(dataSourceName string) string {
+	return k.key(constant.KlcGroupFeedbackPrefix, dataSourceName)
+}
+
+func (k *KeyBuilder) IDFeedbackKey(dataSourceName string, id string) string {
+	return k.key(constant.KlcIDFeedbackPrefix, dataSourceName, id)
+}
+
+func (k *KeyBuilder) RefreshQueueKey() string {
+	return k.key(constant.KlcRefreshPrefix)
+}
+
+func (k *KeyBuilder) RefreshMember(dataSourceName string, id string) string {
+	return Escape(dataSourceName) + ":" + Escape(id)
+}
+
+func (k *KeyBuilder) ParseRefreshMember(member string) (string, string, bool) {
+	pair := strings.Split(member, ":")
+	if len(pair) == 2 {
+		return Unescape(pair[0]), Unescape(pair[1]), true
+	}
+	//members of old versions are joined by KlcIDSeparator
+	pair = strings.Split(member, constant.KlcIDSeparator)
+	if len(pair) == 2 {
+		return pair[0], pair[1], true
+	}
+	return "", "", false
+}
+
+func (k *KeyBuilder) StatisticsKey(parts ...string) string {
+	return k.key(constant.KlcStatisticsPrefix, parts...)
+}
+
+func (k *KeyBuilder) InvalidationChannel() string {
+	return k.key(constant.KlcInvalidationChannel)
+}
+
+func New(namespace string) *KeyBuilder {
+	return &KeyBuilder{Namespace: namespace}
+}
+
+var (
+	_keyBuilder     *KeyBuilder
+	_keyBuilderOnce sync.Once
+)
+
+//GetKeyBuilder returns the key builder without namespace
+func GetKeyBuilder() *KeyBuilder {
+	_keyBuilderOnce.Do(func() {
+		_keyBuilder = New("")
+	})
+	return _keyBuilder
+}
@@ -0,0 +1,46 @@
+package keybuilder
+
+import (
+	"testing"
+)
+
+func TestLegacyKeys(t *testing.T) {
+	k := New("")
+	keys := map[string]string{
+		k.EntryKey("querier-a", "1"):      "klc:cache:entry:querier-a:1",
+		k.RelatedKey("querier-a", "1"):    "klc:cache:related:querier-a:1",
+		k.IDFeedbackKey("querier-a", "1"): "klc:cache:expirecalculator:id:querier-a:1",
+		k.GroupFeedbackKey("querier-a"):   "klc:cache:expirecalculator:group:querier-a",
+		k.GlobalFeedbackKey():             "klc:cache:expirecalculator:global",
+		k.StatisticsKey("hit", "202201"):  "klc:cache:statistics:hit:202201",
+		k.InvalidationChannel():           "klc:cache:invalidation",
+	}
+	for key, expected := range keys {
+		if key != expected {
+			t.Fatalf("unexpected key %v, expected %v", key, expected)
+		}
+	}
+}
+
+func TestNamespaceAndEscape(t *testing.T) {
+	k := New("cms:prod")
+	key := k.EntryKey("querier-a", "x:1")
+	if key != "cms:prod:klc:cache:entry:querier-a:x%3A1" {
+		t.Fatalf("unexpected key %v", key)
+	}
+	if k.EntryKey("a:b", "c") == k.EntryKey("a", "b:c") {
+		t.Fatal("keys should not collide")
+	}
+	if Unescape(Escape("%3A:{x}")) != "%3A:{x}" {
+		t.Fatalf("unexpected unescape: %v", Unescape(Escape("%3A:{x}")))
+	}
+
+	name, id, ok := k.ParseRefreshMember(k.RefreshMember("querier-a", "x:1"))
+	if !ok || name != "querier-a" || id != "x:1" {
+		t.Fatalf("unexpected refresh member: %v, %v, %v", name, id, ok)
+	}
+	name, id, ok = k.ParseRefreshMember("querier_a-1")
+	if !ok || name != "querier_a" || id != "1" {
+		t.Fatalf("unexpected legacy refresh member: %v, %v, %v", name, id, ok)
+	}
+}
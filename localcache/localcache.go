@@ -0,0 +1,121 @@
+package localcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSize   = 1024
+	DefaultExpire = time.Second * 30
+)
+
+type ILocalCache interface {
+	Get(key string) ([]byte, bool)
+	//Set stores value for at most ttl, ttl <= 0 uses the cache expire
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(keys ...string)
+	Purge()
+}
+
+type lruItem struct {
+	key      string
+	value    []byte
+	expireAt time.Time
+}
+
+//LRUCache is a size and ttl bounded cache evicting the least recently used item
+type LRUCache struct {
+	sync.Mutex
+	size   int
+	expire time.Duration
+
+	items map[string]*list.Element
+	order *list.List
+}
+
+func (l *LRUCache) Get(key string) ([]byte, bool) {
+	l.Lock()
+	defer l.Unlock()
+	elem, exists := l.items[key]
+	if !exists {
+		return nil, false
+	}
+	item := elem.Value.(*lruItem)
+	if !time.Now().Before(item.expireAt) {
+		l.removeElement(elem)
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return item.value, true
+}
+
+func (l *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 || ttl > l.expire {
+		ttl = l.expire
+	}
+	l.Lock()
+	defer l.Unlock()
+	expireAt := time.Now().Add(ttl)
+	elem, exists := l.items[key]
+	if exists {
+		item := elem.Value.(*lruItem)
+		item.value = value
+		item.expireAt = expireAt
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruItem{
+		key:      key,
+		value:    value,
+		expireAt: expireAt,
+	})
+	for l.order.Len() > l.size {
+		l.removeElement(l.order.Back())
+	}
+}
+
+func (l *LRUCache) Delete(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for i := range keys {
+		elem, exists := l.items[keys[i]]
+		if exists {
+			l.removeElement(elem)
+		}
+	}
+}
+
+func (l *LRUCache) Purge() {
+	l.Lock()
+	defer l.Unlock()
+	l.items = make(map[string]*list.Element)
+	l.order.Init()
+}
+
+func (l *LRUCache) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.order.Len()
+}
+
+func (l *LRUCache) removeElement(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.items, elem.Value.(*lruItem).key)
+}
+
+func NewLRUCache(size int, expire time.Duration) *LRUCache {
+	if size < 1 {
+		size = DefaultSize
+	}
+	if expire <= 0 {
+		expire = DefaultExpire
+	}
+	return &LRUCache{
+		size:   size,
+		expire: expire,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
@@ -0,0 +1,39 @@
+package localcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvict(t *testing.T) {
+	c := NewLRUCache(2, time.Minute)
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	//touch a, so b is the least recently used
+	c.Get("a")
+	c.Set("c", []byte("3"), 0)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Fatal("a should be kept")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("unexpected size: %v", c.Len())
+	}
+}
+
+func TestLRUCacheExpire(t *testing.T) {
+	c := NewLRUCache(10, time.Minute)
+	c.Set("a", []byte("1"), time.Millisecond*10)
+	c.Set("b", []byte("2"), 0)
+	time.Sleep(time.Millisecond * 20)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("a should be expired")
+	}
+	c.Delete("b")
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be deleted")
+	}
+}
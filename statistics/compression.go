@@ -0,0 +1,80 @@
+package statistics
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/kidsloop-cache/keybuilder"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+type CompressionRatioResponse struct {
+	DataSourceName  string `json:"data_source_name"`
+	RawBytes        int64  `json:"raw_bytes"`
+	StoredBytes     int64  `json:"stored_bytes"`
+	CompressedCount int64  `json:"compressed_count"`
+
+	Ratio float64 `json:"ratio"`
+}
+
+type CompressionRecorder struct {
+	storage    storage.IStorage
+	keyBuilder keybuilder.IKeyBuilder
+}
+
+func (c *CompressionRecorder) SetKeyBuilder(keyBuilder keybuilder.IKeyBuilder) {
+	c.keyBuilder = keyBuilder
+}
+
+//AddCompression records the size of saved entries before and after compression
+func (c *CompressionRecorder) AddCompression(ctx context.Context, dataSourceName string, rawBytes, storedBytes, compressedCount int) {
+	counts := map[string]int{
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionRaw, dataSourceName):        rawBytes,
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionStored, dataSourceName):     storedBytes,
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionCompressed, dataSourceName): compressedCount,
+	}
+	for key, count := range counts {
+		_, err := c.storage.IncrBy(ctx, key, int64(count))
+		if err != nil {
+			log.Error(ctx, "Add compression count failed", log.Err(err), log.String("key", key))
+			return
+		}
+	}
+}
+
+func (c *CompressionRecorder) GetCompressionRatio(ctx context.Context, dataSourceName string) *CompressionRatioResponse {
+	counts, err := c.storage.MGet(ctx, []string{
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionRaw, dataSourceName),
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionStored, dataSourceName),
+		c.keyBuilder.StatisticsKey(statisticsCompression, statisticsCompressionCompressed, dataSourceName),
+	})
+	if err != nil {
+		log.Error(ctx, "Can't connect to storage", log.Err(err))
+		return nil
+	}
+	values := make([]int64, len(counts))
+	for i := range counts {
+		if counts[i] == nil {
+			continue
+		}
+		values[i], err = strconv.ParseInt(string(counts[i]), 10, 64)
+		if err != nil {
+			log.Warn(ctx, "Get compression count failed", log.Err(err))
+		}
+	}
+	response := &CompressionRatioResponse{
+		DataSourceName:  dataSourceName,
+		RawBytes:        values[0],
+		StoredBytes:     values[1],
+		CompressedCount: values[2],
+	}
+	if response.RawBytes > 0 {
+		response.Ratio = float64(response.StoredBytes) / float64(response.RawBytes)
+	}
+	return response
+}
+
+func NewCompressionRecorder(s storage.IStorage) *CompressionRecorder {
+	return &CompressionRecorder{storage: s, keyBuilder: keybuilder.GetKeyBuilder()}
+}
@@ -2,79 +2,99 @@ package statistics
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/KL-Engineering/common-log/log"
-	"github.com/KL-Engineering/kidsloop-cache/constant"
-	"github.com/KL-Engineering/ro"
+	"github.com/KL-Engineering/kidsloop-cache/keybuilder"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
 )
 
 type HitRatioResponse struct {
 	HitCount  int `json:"hit_count"`
 	MissCount int `json:"miss_count"`
+	//NegativeHitCount counts ids found as tombstones, they are not counted in Ratio
+	NegativeHitCount int `json:"negative_hit_count"`
 
 	Ratio float64 `json:"ratio"`
 }
 
 type HitRatioRecorder struct {
+	storage    storage.IStorage
+	keyBuilder keybuilder.IKeyBuilder
+}
+
+func (h *HitRatioRecorder) SetKeyBuilder(keyBuilder keybuilder.IKeyBuilder) {
+	h.keyBuilder = keyBuilder
 }
 
 func (h *HitRatioRecorder) GetCurrentHitRatio(ctx context.Context) *HitRatioResponse {
-	hitKey := h.getRedisKey(ctx, constant.KlcHitCachePrefix)
-	missKey := h.getRedisKey(ctx, constant.KlcMissCachePrefix)
+	hitKey := h.getRedisKey(ctx, statisticsHit)
+	missKey := h.getRedisKey(ctx, statisticsMiss)
+	negativeKey := h.getRedisKey(ctx, statisticsNegativeHit)
 
-	redis, err := ro.GetRedis(ctx)
+	counts, err := h.storage.MGet(ctx, []string{hitKey, missKey, negativeKey})
 	if err != nil {
-		log.Error(ctx, "Can't connect to redis", log.Err(err))
+		log.Error(ctx, "Can't connect to storage", log.Err(err))
 		return nil
 	}
-	hit, err := redis.Get(ctx, hitKey).Int()
+	hit, err := strconv.Atoi(string(counts[0]))
 	if err != nil {
 		hit = 0
 		log.Warn(ctx, "Get hit count failed", log.Err(err))
 	}
 
-	miss, err := redis.Get(ctx, missKey).Int()
+	miss, err := strconv.Atoi(string(counts[1]))
 	if err != nil {
 		miss = 0
 		log.Warn(ctx, "Get miss count failed", log.Err(err))
 	}
-	return h.calculateRatio(ctx, hit, miss)
-}
 
-func (h *HitRatioRecorder) AddHitRatio(ctx context.Context, hitCount, missingCount int) {
-	redis, err := ro.GetRedis(ctx)
-	if err != nil {
-		log.Error(ctx, "Can't connect to redis", log.Err(err))
-		return
+	negative := 0
+	if counts[2] != nil {
+		negative, err = strconv.Atoi(string(counts[2]))
+		if err != nil {
+			negative = 0
+			log.Warn(ctx, "Get negative hit count failed", log.Err(err))
+		}
 	}
+	response := h.calculateRatio(ctx, hit, miss)
+	response.NegativeHitCount = negative
+	return response
+}
 
+func (h *HitRatioRecorder) AddHitRatio(ctx context.Context, hitCount, missingCount int) {
 	//init key/value
-	hitKey := h.getRedisKey(ctx, constant.KlcHitCachePrefix)
-	missKey := h.getRedisKey(ctx, constant.KlcMissCachePrefix)
+	hitKey := h.getRedisKey(ctx, statisticsHit)
+	missKey := h.getRedisKey(ctx, statisticsMiss)
 	log.Debug(ctx, "add hit ratio",
 		log.Int("hitCount", hitCount),
 		log.Int("missingCount", missingCount),
 		log.String("hitKey", hitKey),
 		log.String("missKey", missKey))
-	err = redis.SetNX(ctx, hitKey, "0", 0).Err()
+
+	_, err := h.storage.IncrBy(ctx, hitKey, int64(hitCount))
 	if err != nil {
-		log.Warn(ctx, "Set redis hit key failed", log.Err(err))
+		log.Error(ctx, "Add hit count failed", log.Err(err))
+		return
 	}
-	err = redis.SetNX(ctx, missKey, "0", 0).Err()
+	_, err = h.storage.IncrBy(ctx, missKey, int64(missingCount))
 	if err != nil {
-		log.Warn(ctx, "Set redis miss key failed", log.Err(err))
+		log.Error(ctx, "Add miss count failed", log.Err(err))
+		return
 	}
+}
 
-	err = redis.IncrBy(ctx, hitKey, int64(hitCount)).Err()
-	if err != nil {
-		log.Error(ctx, "Add redis hit count failed", log.Err(err))
+//AddNegativeHit counts ids found as tombstones
+func (h *HitRatioRecorder) AddNegativeHit(ctx context.Context, count int) {
+	if count < 1 {
 		return
 	}
-	err = redis.IncrBy(ctx, missKey, int64(missingCount)).Err()
+	negativeKey := h.getRedisKey(ctx, statisticsNegativeHit)
+	_, err := h.storage.IncrBy(ctx, negativeKey, int64(count))
 	if err != nil {
-		log.Error(ctx, "Add redis miss count failed", log.Err(err))
-		return
+		log.Error(ctx, "Add negative hit count failed", log.Err(err))
 	}
 }
 
@@ -97,10 +117,22 @@ func (h *HitRatioRecorder) calculateRatio(ctx context.Context, hit int, miss int
 func (h *HitRatioRecorder) getRedisKey(ctx context.Context, prefix string) string {
 	return h.getRedisKeyByTime(ctx, prefix, time.Now())
 }
-func (h *HitRatioRecorder) getRedisKeyByTime(ctx context.Context, prefix string, t time.Time) string {
-	return prefix + t.Format("200601")
+func (h *HitRatioRecorder) getRedisKeyByTime(ctx context.Context, name string, t time.Time) string {
+	return h.keyBuilder.StatisticsKey(name, t.Format("200601"))
 }
 
+func NewHitRatioRecorder(s storage.IStorage) *HitRatioRecorder {
+	return &HitRatioRecorder{storage: s, keyBuilder: keybuilder.GetKeyBuilder()}
+}
+
+var (
+	_hitRatioRecorder     *HitRatioRecorder
+	_hitRatioRecorderOnce sync.Once
+)
+
 func GetHitRatioRecorder() *HitRatioRecorder {
-	return new(HitRatioRecorder)
+	_hitRatioRecorderOnce.Do(func() {
+		_hitRatioRecorder = NewHitRatioRecorder(storage.GetRedisStorage())
+	})
+	return _hitRatioRecorder
 }
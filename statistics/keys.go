@@ -0,0 +1,13 @@
+package statistics
+
+//names of statistics keys built by keybuilder.IKeyBuilder.StatisticsKey
+const (
+	statisticsHit         = "hit"
+	statisticsMiss        = "miss"
+	statisticsNegativeHit = "negative"
+
+	statisticsCompression           = "compression"
+	statisticsCompressionRaw        = "raw"
+	statisticsCompressionStored     = "stored"
+	statisticsCompressionCompressed = "compressed"
+)
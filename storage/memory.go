@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	memorySweepInterval = time.Minute
+)
+
+type memoryValue struct {
+	data     []byte
+	expireAt time.Time
+}
+
+type memorySet struct {
+	members  map[string]struct{}
+	expireAt time.Time
+}
+
+type memoryList struct {
+	//values[0] is the head of the list
+	values   []string
+	expireAt time.Time
+}
+
+//MemoryStorage is an in-process storage, it's safe for concurrent use
+//but isn't shared between processes
+type MemoryStorage struct {
+	sync.Mutex
+	values map[string]*memoryValue
+	sets   map[string]*memorySet
+	lists  map[string]*memoryList
+
+	nextSweep time.Time
+	pubSub    memoryPubSub
+}
+
+func (m *MemoryStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		v := m.getValue(keys[i], now)
+		if v == nil {
+			continue
+		}
+		values[i] = append([]byte{}, v.data...)
+	}
+	return values, nil
+}
+
+func (m *MemoryStorage) MSet(ctx context.Context, entries []*Entry) error {
+	return m.Write(ctx, &Batch{Entries: entries})
+}
+
+func (m *MemoryStorage) Write(ctx context.Context, batch *Batch) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	for i := range batch.Entries {
+		m.setValue(batch.Entries[i], now)
+	}
+	for i := range batch.Sets {
+		m.addMembers(batch.Sets[i], now)
+	}
+	m.sweep(now)
+	return nil
+}
+
+func (m *MemoryStorage) CompareAndWrite(ctx context.Context, batch *Batch) ([]bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	result := make([]bool, len(batch.Entries))
+	for i := range batch.Entries {
+		if batch.Entries[i].Expected != nil {
+			current := m.getValue(batch.Entries[i].Key, now)
+			if current == nil || !bytes.Equal(current.data, batch.Entries[i].Expected) {
+				continue
+			}
+		}
+		m.setValue(batch.Entries[i], now)
+		result[i] = true
+	}
+	for i := range batch.Sets {
+		m.addMembers(batch.Sets[i], now)
+	}
+	m.sweep(now)
+	return result, nil
+}
+
+func (m *MemoryStorage) setValue(entry *Entry, now time.Time) {
+	m.deleteKey(entry.Key)
+	m.values[entry.Key] = &memoryValue{
+		data:     append([]byte{}, entry.Value...),
+		expireAt: expireAt(now, entry.TTL),
+	}
+}
+
+func (m *MemoryStorage) addMembers(entry *SetEntry, now time.Time) {
+	if len(entry.Members) < 1 {
+		return
+	}
+	set := m.getSet(entry.Key, now)
+	if set == nil {
+		set = &memorySet{members: make(map[string]struct{})}
+		m.sets[entry.Key] = set
+	}
+	for i := range entry.Members {
+		set.members[entry.Members[i]] = struct{}{}
+	}
+	if entry.TTL > 0 {
+		set.expireAt = now.Add(entry.TTL)
+	}
+}
+
+func (m *MemoryStorage) SetNX(ctx context.Context, entries []*Entry) ([]bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	result := make([]bool, len(entries))
+	for i := range entries {
+		if m.getValue(entries[i].Key, now) != nil || m.getSet(entries[i].Key, now) != nil || m.getList(entries[i].Key, now) != nil {
+			continue
+		}
+		m.values[entries[i].Key] = &memoryValue{
+			data:     append([]byte{}, entries[i].Value...),
+			expireAt: expireAt(now, entries[i].TTL),
+		}
+		result[i] = true
+	}
+	m.sweep(now)
+	return result, nil
+}
+
+func (m *MemoryStorage) Del(ctx context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range keys {
+		m.deleteKey(keys[i])
+	}
+	return nil
+}
+
+func (m *MemoryStorage) CompareAndDel(ctx context.Context, entries []*Entry) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	for i := range entries {
+		current := m.getValue(entries[i].Key, now)
+		if current != nil && bytes.Equal(current.data, entries[i].Value) {
+			m.deleteKey(entries[i].Key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) SAdd(ctx context.Context, key string, members []string, ttl time.Duration) error {
+	return m.Write(ctx, &Batch{Sets: []*SetEntry{{Key: key, Members: members, TTL: ttl}}})
+}
+
+func (m *MemoryStorage) SMembers(ctx context.Context, key string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	set := m.getSet(key, time.Now())
+	if set == nil {
+		return nil, nil
+	}
+	members := make([]string, 0, len(set.members))
+	for member := range set.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *MemoryStorage) SMembersMulti(ctx context.Context, keys []string) ([][]string, error) {
+	result := make([][]string, len(keys))
+	for i := range keys {
+		members, err := m.SMembers(ctx, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		result[i] = members
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) SPopN(ctx context.Context, key string, count int64) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	set := m.getSet(key, time.Now())
+	if set == nil {
+		return nil, nil
+	}
+	members := make([]string, 0, count)
+	for member := range set.members {
+		if int64(len(members)) >= count {
+			break
+		}
+		members = append(members, member)
+		delete(set.members, member)
+	}
+	if len(set.members) == 0 {
+		delete(m.sets, key)
+	}
+	return members, nil
+}
+
+func (m *MemoryStorage) LPush(ctx context.Context, key string, values []string) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	list := m.getList(key, now)
+	if list == nil {
+		list = new(memoryList)
+		m.lists[key] = list
+	}
+	head := make([]string, len(values), len(values)+len(list.values))
+	for i := range values {
+		head[len(values)-1-i] = values[i]
+	}
+	list.values = append(head, list.values...)
+	m.sweep(now)
+	return nil
+}
+
+func (m *MemoryStorage) LPushMulti(ctx context.Context, lists []*ListEntry) error {
+	for i := range lists {
+		err := m.LPush(ctx, lists[i].Key, lists[i].Values)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	list := m.getList(key, time.Now())
+	if list == nil {
+		return nil, nil
+	}
+	from, to, ok := listRange(int64(len(list.values)), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+	return append([]string{}, list.values[from:to]...), nil
+}
+
+func (m *MemoryStorage) LTrim(ctx context.Context, key string, start, stop int64) error {
+	m.Lock()
+	defer m.Unlock()
+	list := m.getList(key, time.Now())
+	if list == nil {
+		return nil
+	}
+	from, to, ok := listRange(int64(len(list.values)), start, stop)
+	if !ok {
+		delete(m.lists, key)
+		return nil
+	}
+	list.values = append([]string{}, list.values[from:to]...)
+	return nil
+}
+
+func (m *MemoryStorage) LLen(ctx context.Context, key string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	list := m.getList(key, time.Now())
+	if list == nil {
+		return 0, nil
+	}
+	return int64(len(list.values)), nil
+}
+
+func (m *MemoryStorage) IncrBy(ctx context.Context, key string, value int64) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	v := m.getValue(key, time.Now())
+	if v == nil {
+		v = new(memoryValue)
+		m.values[key] = v
+	}
+	current := int64(0)
+	if len(v.data) > 0 {
+		var err error
+		current, err = strconv.ParseInt(string(v.data), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	current = current + value
+	v.data = []byte(strconv.FormatInt(current, 10))
+	return current, nil
+}
+
+func (m *MemoryStorage) getValue(key string, now time.Time) *memoryValue {
+	v, exists := m.values[key]
+	if !exists {
+		return nil
+	}
+	if expired(now, v.expireAt) {
+		delete(m.values, key)
+		return nil
+	}
+	return v
+}
+
+func (m *MemoryStorage) getSet(key string, now time.Time) *memorySet {
+	set, exists := m.sets[key]
+	if !exists {
+		return nil
+	}
+	if expired(now, set.expireAt) {
+		delete(m.sets, key)
+		return nil
+	}
+	return set
+}
+
+func (m *MemoryStorage) getList(key string, now time.Time) *memoryList {
+	list, exists := m.lists[key]
+	if !exists {
+		return nil
+	}
+	if expired(now, list.expireAt) {
+		delete(m.lists, key)
+		return nil
+	}
+	return list
+}
+
+func (m *MemoryStorage) deleteKey(key string) {
+	delete(m.values, key)
+	delete(m.sets, key)
+	delete(m.lists, key)
+}
+
+//sweep drops expired keys which are never read again
+func (m *MemoryStorage) sweep(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+	m.nextSweep = now.Add(memorySweepInterval)
+	for key, v := range m.values {
+		if expired(now, v.expireAt) {
+			delete(m.values, key)
+		}
+	}
+	for key, set := range m.sets {
+		if expired(now, set.expireAt) {
+			delete(m.sets, key)
+		}
+	}
+	for key, list := range m.lists {
+		if expired(now, list.expireAt) {
+			delete(m.lists, key)
+		}
+	}
+}
+
+func expireAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func expired(now time.Time, expireAt time.Time) bool {
+	return !expireAt.IsZero() && !now.Before(expireAt)
+}
+
+//listRange converts redis style inclusive indexes into a slice range
+func listRange(length, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	return start, stop + 1, true
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		values: make(map[string]*memoryValue),
+		sets:   make(map[string]*memorySet),
+		lists:  make(map[string]*memoryList),
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorageEntries(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	err := m.MSet(ctx, []*Entry{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2"), TTL: time.Millisecond * 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := m.MGet(ctx, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "1" || string(values[1]) != "2" || values[2] != nil {
+		t.Fatalf("unexpected values: %q", values)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	values, _ = m.MGet(ctx, []string{"a", "b"})
+	if string(values[0]) != "1" || values[1] != nil {
+		t.Fatalf("b should be expired: %q", values)
+	}
+
+	_ = m.Del(ctx, []string{"a"})
+	values, _ = m.MGet(ctx, []string{"a"})
+	if values[0] != nil {
+		t.Fatalf("a should be deleted: %q", values)
+	}
+}
+
+func TestMemoryStorageSetAndList(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	_ = m.SAdd(ctx, "set", []string{"x", "y", "x"}, 0)
+	members, _ := m.SMembers(ctx, "set")
+	if len(members) != 2 {
+		t.Fatalf("unexpected members: %v", members)
+	}
+	sets, _ := m.SMembersMulti(ctx, []string{"missing", "set"})
+	if len(sets) != 2 || sets[0] != nil || len(sets[1]) != 2 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	popped, _ := m.SPopN(ctx, "set", 5)
+	if len(popped) != 2 {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+
+	_ = m.LPush(ctx, "list", []string{"1", "2"})
+	_ = m.LPush(ctx, "list", []string{"3"})
+	values, _ := m.LRange(ctx, "list", 0, -1)
+	if len(values) != 3 || values[0] != "3" || values[1] != "2" || values[2] != "1" {
+		t.Fatalf("unexpected list: %v", values)
+	}
+	_ = m.LTrim(ctx, "list", 0, 1)
+	values, _ = m.LRange(ctx, "list", 0, 10)
+	if len(values) != 2 || values[1] != "2" {
+		t.Fatalf("unexpected trimmed list: %v", values)
+	}
+	length, _ := m.LLen(ctx, "list")
+	if length != 2 {
+		t.Fatalf("unexpected length: %v", length)
+	}
+
+	_ = m.LPushMulti(ctx, []*ListEntry{{Key: "list", Values: []string{"4"}}, {Key: "other", Values: []string{"5"}}})
+	values, _ = m.LRange(ctx, "list", 0, 0)
+	others, _ := m.LRange(ctx, "other", 0, -1)
+	if len(values) != 1 || values[0] != "4" || len(others) != 1 || others[0] != "5" {
+		t.Fatalf("unexpected lists: %v, %v", values, others)
+	}
+}
+
+func TestMemoryStorageWriteBatch(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	err := m.Write(ctx, &Batch{
+		Entries: []*Entry{
+			{Key: "a", Value: []byte("1"), TTL: time.Millisecond * 10},
+			{Key: "b", Value: []byte("2")},
+		},
+		Sets: []*SetEntry{
+			{Key: "s", Members: []string{"x", "y"}, TTL: time.Millisecond * 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, _ := m.SMembers(ctx, "s")
+	if len(members) != 2 {
+		t.Fatalf("unexpected members: %v", members)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	values, _ := m.MGet(ctx, []string{"a", "b"})
+	if values[0] != nil || string(values[1]) != "2" {
+		t.Fatalf("a should be expired: %q", values)
+	}
+	members, _ = m.SMembers(ctx, "s")
+	if len(members) != 0 {
+		t.Fatalf("s should be expired: %v", members)
+	}
+}
+
+func TestMemoryStorageIncrBy(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	_, _ = m.IncrBy(ctx, "counter", 3)
+	n, err := m.IncrBy(ctx, "counter", 4)
+	if err != nil || n != 7 {
+		t.Fatalf("unexpected counter: %v, %v", n, err)
+	}
+	values, _ := m.MGet(ctx, []string{"counter"})
+	if string(values[0]) != "7" {
+		t.Fatalf("unexpected counter value: %q", values[0])
+	}
+}
+
+func TestMemoryStoragePubSub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMemoryStorage()
+	messages, err := m.Subscribe(ctx, "channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Publish(ctx, "channel", []byte("hello"))
+	_ = m.Publish(ctx, "other", []byte("ignored"))
+	msg := <-messages
+	if string(msg.Payload) != "hello" || msg.Reset {
+		t.Fatalf("unexpected message: %#v", msg)
+	}
+
+	cancel()
+	for range messages {
+	}
+}
+
+func TestMemoryStorageCompareAndWrite(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	err := m.MSet(ctx, []*Entry{{Key: "a", Value: []byte("lease-a")}, {Key: "b", Value: []byte("lease-b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := m.CompareAndWrite(ctx, &Batch{
+		Entries: []*Entry{
+			{Key: "a", Value: []byte("1"), Expected: []byte("lease-a")},
+			{Key: "b", Value: []byte("2"), Expected: []byte("other")},
+			{Key: "c", Value: []byte("3"), Expected: []byte("lease-c")},
+			{Key: "d", Value: []byte("4")},
+		},
+		Sets: []*SetEntry{{Key: "s", Members: []string{"x"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !written[0] || written[1] || written[2] || !written[3] {
+		t.Fatalf("unexpected result: %v", written)
+	}
+	values, _ := m.MGet(ctx, []string{"a", "b", "c", "d"})
+	if string(values[0]) != "1" || string(values[1]) != "lease-b" || values[2] != nil || string(values[3]) != "4" {
+		t.Fatalf("unexpected values: %q", values)
+	}
+	members, _ := m.SMembers(ctx, "s")
+	if len(members) != 1 {
+		t.Fatalf("sets should be written: %v", members)
+	}
+}
+
+func TestMemoryStorageCompareAndDel(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	err := m.MSet(ctx, []*Entry{{Key: "a", Value: []byte("token-a")}, {Key: "b", Value: []byte("token-b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CompareAndDel(ctx, []*Entry{
+		{Key: "a", Value: []byte("token-a")},
+		{Key: "b", Value: []byte("other")},
+		{Key: "c", Value: []byte("token-c")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := m.MGet(ctx, []string{"a", "b", "c"})
+	if values[0] != nil || string(values[1]) != "token-b" || values[2] != nil {
+		t.Fatalf("unexpected values: %q", values)
+	}
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+type memorySubscriber struct {
+	messages chan *Message
+	//lost is set when a message was dropped because the subscriber is too slow
+	lost bool
+}
+
+type memoryPubSub struct {
+	sync.Mutex
+	subscribers map[string]map[*memorySubscriber]struct{}
+}
+
+func (m *MemoryStorage) Publish(ctx context.Context, channel string, payload []byte) error {
+	m.pubSub.Lock()
+	defer m.pubSub.Unlock()
+	for sub := range m.pubSub.subscribers[channel] {
+		if sub.lost {
+			select {
+			case sub.messages <- &Message{Reset: true}:
+				sub.lost = false
+			default:
+				continue
+			}
+		}
+		select {
+		case sub.messages <- &Message{Payload: append([]byte{}, payload...)}:
+		default:
+			sub.lost = true
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Subscribe(ctx context.Context, channel string) (<-chan *Message, error) {
+	sub := &memorySubscriber{messages: make(chan *Message, pubSubChannelSize)}
+	m.pubSub.Lock()
+	if m.pubSub.subscribers == nil {
+		m.pubSub.subscribers = make(map[string]map[*memorySubscriber]struct{})
+	}
+	if m.pubSub.subscribers[channel] == nil {
+		m.pubSub.subscribers[channel] = make(map[*memorySubscriber]struct{})
+	}
+	m.pubSub.subscribers[channel][sub] = struct{}{}
+	m.pubSub.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.pubSub.Lock()
+		delete(m.pubSub.subscribers[channel], sub)
+		close(sub.messages)
+		m.pubSub.Unlock()
+	}()
+	return sub.messages, nil
+}
@@ -0,0 +1,496 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/KL-Engineering/ro"
+	"github.com/go-redis/redis/v8"
+)
+
+//RedisStorage works with a single redis, a redis cluster or a sentinel,
+//multi-key commands are split by hash slot on a cluster
+type RedisStorage struct {
+	getClient func(ctx context.Context) (redis.UniversalClient, error)
+}
+
+//groupKeys groups indexes of keys by hash slot for cluster clients, other clients take all keys at once
+func (r *RedisStorage) groupKeys(client redis.UniversalClient, keys []string) [][]int {
+	_, cluster := client.(*redis.ClusterClient)
+	if cluster {
+		return groupBySlot(keys)
+	}
+	indexes := make([]int, len(keys))
+	for i := range keys {
+		indexes[i] = i
+	}
+	return [][]int{indexes}
+}
+
+func (r *RedisStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	if len(keys) < 1 {
+		return nil, nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	groups := r.groupKeys(client, keys)
+	err = fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		indexes := groups[group]
+		res, err := client.MGet(ctx, pickStrings(keys, indexes)...).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := range res {
+			data, ok := res[i].(string)
+			if !ok {
+				continue
+			}
+			values[indexes[i]] = []byte(data)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(ctx, "MGet failed", log.Err(err), log.Strings("keys", keys))
+		return nil, err
+	}
+	return values, nil
+}
+
+func (r *RedisStorage) MSet(ctx context.Context, entries []*Entry) error {
+	if len(entries) < 1 {
+		return nil
+	}
+	return r.Write(ctx, &Batch{Entries: entries})
+}
+
+func (r *RedisStorage) Write(ctx context.Context, batch *Batch) error {
+	if len(batch.Entries) < 1 && len(batch.Sets) < 1 {
+		return nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	//keys of entries come first, then keys of sets
+	keys := make([]string, 0, len(batch.Entries)+len(batch.Sets))
+	for i := range batch.Entries {
+		keys = append(keys, batch.Entries[i].Key)
+	}
+	for i := range batch.Sets {
+		keys = append(keys, batch.Sets[i].Key)
+	}
+	//MULTI/EXEC sends the batch in one round trip and applies it atomically,
+	//on a cluster a transaction can't cross hash slots, so the batch is atomic per slot
+	groups := r.groupKeys(client, keys)
+	err = fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, index := range groups[group] {
+				if index < len(batch.Entries) {
+					entry := batch.Entries[index]
+					pipe.Set(ctx, entry.Key, entry.Value, redisTTL(entry.TTL))
+					continue
+				}
+				set := batch.Sets[index-len(batch.Entries)]
+				if len(set.Members) < 1 {
+					continue
+				}
+				pipe.SAdd(ctx, set.Key, stringsToInterfaces(set.Members)...)
+				if set.TTL > 0 {
+					pipe.Expire(ctx, set.Key, set.TTL)
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		log.Error(ctx, "Write batch failed",
+			log.Err(err),
+			log.Int("entries", len(batch.Entries)),
+			log.Int("sets", len(batch.Sets)))
+		return err
+	}
+	return nil
+}
+
+//compareAndWriteScript takes keys of entries then keys of sets,
+//ARGV is the number of entries, then value, ttl in ms, whether expected is set and expected of every entry,
+//then ttl in ms, the number of members and members of every set
+var compareAndWriteScript = redis.NewScript(`
+local count = tonumber(ARGV[1])
+local result = {}
+local arg = 2
+for i = 1, count do
+	local set = 1
+	if ARGV[arg + 2] == "1" and redis.call("GET", KEYS[i]) ~= ARGV[arg + 3] then
+		set = 0
+	end
+	if set == 1 then
+		local ttl = tonumber(ARGV[arg + 1])
+		if ttl > 0 then
+			redis.call("SET", KEYS[i], ARGV[arg], "PX", ttl)
+		else
+			redis.call("SET", KEYS[i], ARGV[arg])
+		end
+	end
+	result[i] = set
+	arg = arg + 4
+end
+for i = count + 1, #KEYS do
+	local ttl = tonumber(ARGV[arg])
+	local members = tonumber(ARGV[arg + 1])
+	arg = arg + 2
+	if members > 0 then
+		redis.call("SADD", KEYS[i], unpack(ARGV, arg, arg + members - 1))
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[i], ttl)
+		end
+	end
+	arg = arg + members
+end
+return result
+`)
+
+//CompareAndWrite runs a script per hash slot on a cluster, so the batch is atomic per slot
+func (r *RedisStorage) CompareAndWrite(ctx context.Context, batch *Batch) ([]bool, error) {
+	if len(batch.Entries) < 1 && len(batch.Sets) < 1 {
+		return nil, nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	keys := make([]string, 0, len(batch.Entries)+len(batch.Sets))
+	for i := range batch.Entries {
+		keys = append(keys, batch.Entries[i].Key)
+	}
+	for i := range batch.Sets {
+		keys = append(keys, batch.Sets[i].Key)
+	}
+	result := make([]bool, len(batch.Entries))
+	groups := r.groupKeys(client, keys)
+	err = fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		entryIndexes := make([]int, 0, len(groups[group]))
+		scriptKeys := make([]string, 0, len(groups[group]))
+		entryArgs := []interface{}{0}
+		setArgs := make([]interface{}, 0)
+		for _, index := range groups[group] {
+			if index < len(batch.Entries) {
+				entry := batch.Entries[index]
+				expected := "0"
+				if entry.Expected != nil {
+					expected = "1"
+				}
+				entryIndexes = append(entryIndexes, index)
+				scriptKeys = append(scriptKeys, entry.Key)
+				entryArgs = append(entryArgs, entry.Value, redisTTL(entry.TTL).Milliseconds(), expected, entry.Expected)
+				continue
+			}
+			set := batch.Sets[index-len(batch.Entries)]
+			setArgs = append(setArgs, set.TTL.Milliseconds(), len(set.Members))
+			setArgs = append(setArgs, stringsToInterfaces(set.Members)...)
+		}
+		entryArgs[0] = len(entryIndexes)
+		//keys of sets follow keys of entries
+		for _, index := range groups[group] {
+			if index >= len(batch.Entries) {
+				scriptKeys = append(scriptKeys, keys[index])
+			}
+		}
+		res, err := compareAndWriteScript.Run(ctx, client, scriptKeys, append(entryArgs, setArgs...)...).Int64Slice()
+		if err != nil {
+			return err
+		}
+		for i := range res {
+			result[entryIndexes[i]] = res[i] == 1
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(ctx, "CompareAndWrite batch failed",
+			log.Err(err),
+			log.Int("entries", len(batch.Entries)),
+			log.Int("sets", len(batch.Sets)))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) SetNX(ctx context.Context, entries []*Entry) ([]bool, error) {
+	if len(entries) < 1 {
+		return nil, nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	cmds := make([]*redis.BoolCmd, len(entries))
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range entries {
+			cmds[i] = pipe.SetNX(ctx, entries[i].Key, entries[i].Value, redisTTL(entries[i].TTL))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(ctx, "SetNX failed", log.Err(err))
+		return nil, err
+	}
+	result := make([]bool, len(entries))
+	for i := range cmds {
+		result[i] = cmds[i].Val()
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) Del(ctx context.Context, keys []string) error {
+	if len(keys) < 1 {
+		return nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	groups := r.groupKeys(client, keys)
+	return fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		return client.Del(ctx, pickStrings(keys, groups[group])...).Err()
+	})
+}
+
+//compareAndDelScript deletes every key in KEYS whose value equals the ARGV at the same index
+var compareAndDelScript = redis.NewScript(`
+for i = 1, #KEYS do
+	if redis.call("GET", KEYS[i]) == ARGV[i] then
+		redis.call("DEL", KEYS[i])
+	end
+end
+return 0
+`)
+
+//CompareAndDel runs a script per hash slot on a cluster
+func (r *RedisStorage) CompareAndDel(ctx context.Context, entries []*Entry) error {
+	if len(entries) < 1 {
+		return nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+	groups := r.groupKeys(client, keys)
+	return fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		values := make([]interface{}, len(groups[group]))
+		for i, index := range groups[group] {
+			values[i] = entries[index].Value
+		}
+		return compareAndDelScript.Run(ctx, client, pickStrings(keys, groups[group]), values...).Err()
+	})
+}
+
+func (r *RedisStorage) SAdd(ctx context.Context, key string, members []string, ttl time.Duration) error {
+	if len(members) < 1 {
+		return nil
+	}
+	return r.Write(ctx, &Batch{Sets: []*SetEntry{{Key: key, Members: members, TTL: ttl}}})
+}
+
+func (r *RedisStorage) SMembers(ctx context.Context, key string) ([]string, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	res, err := client.SMembers(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+//SMembersMulti pipelines SMEMBERS per hash slot
+func (r *RedisStorage) SMembersMulti(ctx context.Context, keys []string) ([][]string, error) {
+	if len(keys) < 1 {
+		return nil, nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	result := make([][]string, len(keys))
+	groups := r.groupKeys(client, keys)
+	err = fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		indexes := groups[group]
+		cmds := make([]*redis.StringSliceCmd, len(indexes))
+		_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := range indexes {
+				cmds[i] = pipe.SMembers(ctx, keys[indexes[i]])
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		for i := range cmds {
+			result[indexes[i]] = cmds[i].Val()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(ctx, "SMembersMulti failed", log.Err(err), log.Strings("keys", keys))
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) SPopN(ctx context.Context, key string, count int64) ([]string, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	res, err := client.SPopN(ctx, key, count).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (r *RedisStorage) LPush(ctx context.Context, key string, values []string) error {
+	if len(values) < 1 {
+		return nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	return client.LPush(ctx, key, stringsToInterfaces(values)...).Err()
+}
+
+//LPushMulti pipelines LPUSH per hash slot
+func (r *RedisStorage) LPushMulti(ctx context.Context, lists []*ListEntry) error {
+	if len(lists) < 1 {
+		return nil
+	}
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	keys := make([]string, len(lists))
+	for i := range lists {
+		keys[i] = lists[i].Key
+	}
+	groups := r.groupKeys(client, keys)
+	return fanOut(ctx, len(groups), func(ctx context.Context, group int) error {
+		_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, index := range groups[group] {
+				if len(lists[index].Values) < 1 {
+					continue
+				}
+				pipe.LPush(ctx, lists[index].Key, stringsToInterfaces(lists[index].Values)...)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+func (r *RedisStorage) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	res, err := client.LRange(ctx, key, start, stop).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (r *RedisStorage) LTrim(ctx context.Context, key string, start, stop int64) error {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	return client.LTrim(ctx, key, start, stop).Err()
+}
+
+func (r *RedisStorage) LLen(ctx context.Context, key string) (int64, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return 0, err
+	}
+	return client.LLen(ctx, key).Result()
+}
+
+func (r *RedisStorage) IncrBy(ctx context.Context, key string, value int64) (int64, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return 0, err
+	}
+	return client.IncrBy(ctx, key, value).Result()
+}
+
+//redisTTL converts TTL <= 0 into 0 which means no expiration, negative values have special meanings in go-redis
+func redisTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+	return ttl
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	res := make([]interface{}, len(values))
+	for i := range values {
+		res[i] = values[i]
+	}
+	return res
+}
+
+func NewRedisStorage(getClient func(ctx context.Context) (*redis.Client, error)) *RedisStorage {
+	return &RedisStorage{getClient: func(ctx context.Context) (redis.UniversalClient, error) {
+		return getClient(ctx)
+	}}
+}
+
+//NewUniversalRedisStorage creates a storage on a client of redis.NewUniversalClient, e.g. a *redis.ClusterClient
+func NewUniversalRedisStorage(client redis.UniversalClient) *RedisStorage {
+	return &RedisStorage{getClient: func(ctx context.Context) (redis.UniversalClient, error) {
+		return client, nil
+	}}
+}
+
+var (
+	_redisStorage     *RedisStorage
+	_redisStorageOnce sync.Once
+)
+
+//GetRedisStorage returns the storage backed by ro.GetRedis
+func GetRedisStorage() *RedisStorage {
+	_redisStorageOnce.Do(func() {
+		_redisStorage = NewRedisStorage(ro.GetRedis)
+	})
+	return _redisStorage
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/KL-Engineering/common-log/log"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	pubSubPingInterval   = time.Second * 30
+	pubSubMaxRetryPeriod = time.Second * 5
+	pubSubChannelSize    = 100
+)
+
+func (r *RedisStorage) Publish(ctx context.Context, channel string, payload []byte) error {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return err
+	}
+	return client.Publish(ctx, channel, payload).Err()
+}
+
+func (r *RedisStorage) Subscribe(ctx context.Context, channel string) (<-chan *Message, error) {
+	client, err := r.getClient(ctx)
+	if err != nil {
+		log.Error(ctx, "GetRedis failed", log.Err(err))
+		return nil, err
+	}
+	pubSub := client.Subscribe(ctx, channel)
+	//wait for confirmation, so no message published after Subscribe returns is lost
+	_, err = pubSub.Receive(ctx)
+	if err != nil {
+		log.Error(ctx, "Subscribe failed", log.Err(err), log.String("channel", channel))
+		pubSub.Close()
+		return nil, err
+	}
+
+	messages := make(chan *Message, pubSubChannelSize)
+	go r.receive(ctx, pubSub, channel, messages)
+	return messages, nil
+}
+
+//receive reads pubSub until ctx is done, a Reset message is delivered
+//after the connection was interrupted and subscribed again
+func (r *RedisStorage) receive(ctx context.Context, pubSub *redis.PubSub, channel string, messages chan<- *Message) {
+	defer close(messages)
+	defer pubSub.Close()
+
+	interrupted := false
+	retryPeriod := time.Duration(0)
+	for {
+		msg, err := pubSub.ReceiveTimeout(ctx, pubSubPingInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !interrupted {
+				//idle, check the connection is still alive
+				_ = pubSub.Ping(ctx)
+				continue
+			}
+			log.Warn(ctx, "receive subscription failed", log.Err(err), log.String("channel", channel))
+			interrupted = true
+			retryPeriod = retryPeriod*2 + time.Millisecond*100
+			if retryPeriod > pubSubMaxRetryPeriod {
+				retryPeriod = pubSubMaxRetryPeriod
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryPeriod):
+			}
+			continue
+		}
+		retryPeriod = 0
+
+		if interrupted {
+			interrupted = false
+			if !r.deliver(ctx, messages, &Message{Reset: true}) {
+				return
+			}
+		}
+		m, ok := msg.(*redis.Message)
+		if !ok {
+			continue
+		}
+		if !r.deliver(ctx, messages, &Message{Payload: []byte(m.Payload)}) {
+			return
+		}
+	}
+}
+
+func (r *RedisStorage) deliver(ctx context.Context, messages chan<- *Message, msg *Message) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case messages <- msg:
+		return true
+	}
+}
@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+)
+
+var (
+	ErrNoStorageNode      = errors.New("no storage node")
+	ErrDuplicateNode      = errors.New("duplicate storage node")
+	ErrStorageNodeMissing = errors.New("storage node doesn't exist")
+)
+
+//ShardedStorage spreads keys across independent storages with rendezvous hashing,
+//adding or removing a node only moves keys from or to that node.
+//Keys are routed by their hash tag like redis cluster, so keys sharing a {tag} are on the same node
+type ShardedStorage struct {
+	sync.RWMutex
+	nodes map[string]IStorage
+	hash  *rendezvous.Rendezvous
+}
+
+//node returns the storage of key
+func (s *ShardedStorage) node(key string) (IStorage, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.nodes) < 1 {
+		return nil, ErrNoStorageNode
+	}
+	return s.nodes[s.hash.Lookup(hashTag(key))], nil
+}
+
+//groupKeys groups indexes of keys by node
+func (s *ShardedStorage) groupKeys(keys []string) ([]IStorage, [][]int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.nodes) < 1 {
+		return nil, nil, ErrNoStorageNode
+	}
+	nodes := make([]IStorage, 0)
+	groups := make([][]int, 0)
+	nodeGroups := make(map[string]int)
+	for i := range keys {
+		name := s.hash.Lookup(hashTag(keys[i]))
+		groupIndex, exists := nodeGroups[name]
+		if !exists {
+			groupIndex = len(groups)
+			nodeGroups[name] = groupIndex
+			nodes = append(nodes, s.nodes[name])
+			groups = append(groups, nil)
+		}
+		groups[groupIndex] = append(groups[groupIndex], i)
+	}
+	return nodes, groups, nil
+}
+
+//eachNode groups keys by node and calls fn for every node in parallel
+func (s *ShardedStorage) eachNode(ctx context.Context, keys []string, fn func(ctx context.Context, node IStorage, indexes []int) error) error {
+	if len(keys) < 1 {
+		return nil
+	}
+	nodes, groups, err := s.groupKeys(keys)
+	if err != nil {
+		return err
+	}
+	return fanOut(ctx, len(nodes), func(ctx context.Context, group int) error {
+		return fn(ctx, nodes[group], groups[group])
+	})
+}
+
+func (s *ShardedStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	err := s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeValues, err := node.MGet(ctx, pickStrings(keys, indexes))
+		if err != nil {
+			return err
+		}
+		for i := range nodeValues {
+			values[indexes[i]] = nodeValues[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (s *ShardedStorage) MSet(ctx context.Context, entries []*Entry) error {
+	return s.Write(ctx, &Batch{Entries: entries})
+}
+
+//Write is atomic per node
+func (s *ShardedStorage) Write(ctx context.Context, batch *Batch) error {
+	//keys of entries come first, then keys of sets
+	keys := make([]string, 0, len(batch.Entries)+len(batch.Sets))
+	for i := range batch.Entries {
+		keys = append(keys, batch.Entries[i].Key)
+	}
+	for i := range batch.Sets {
+		keys = append(keys, batch.Sets[i].Key)
+	}
+	return s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeBatch := new(Batch)
+		for _, index := range indexes {
+			if index < len(batch.Entries) {
+				nodeBatch.Entries = append(nodeBatch.Entries, batch.Entries[index])
+				continue
+			}
+			nodeBatch.Sets = append(nodeBatch.Sets, batch.Sets[index-len(batch.Entries)])
+		}
+		return node.Write(ctx, nodeBatch)
+	})
+}
+
+//CompareAndWrite is atomic per node
+func (s *ShardedStorage) CompareAndWrite(ctx context.Context, batch *Batch) ([]bool, error) {
+	keys := make([]string, 0, len(batch.Entries)+len(batch.Sets))
+	for i := range batch.Entries {
+		keys = append(keys, batch.Entries[i].Key)
+	}
+	for i := range batch.Sets {
+		keys = append(keys, batch.Sets[i].Key)
+	}
+	result := make([]bool, len(batch.Entries))
+	err := s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeBatch := new(Batch)
+		entryIndexes := make([]int, 0, len(indexes))
+		for _, index := range indexes {
+			if index < len(batch.Entries) {
+				nodeBatch.Entries = append(nodeBatch.Entries, batch.Entries[index])
+				entryIndexes = append(entryIndexes, index)
+				continue
+			}
+			nodeBatch.Sets = append(nodeBatch.Sets, batch.Sets[index-len(batch.Entries)])
+		}
+		nodeResult, err := node.CompareAndWrite(ctx, nodeBatch)
+		if err != nil {
+			return err
+		}
+		for i := range nodeResult {
+			result[entryIndexes[i]] = nodeResult[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *ShardedStorage) SetNX(ctx context.Context, entries []*Entry) ([]bool, error) {
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+	result := make([]bool, len(entries))
+	err := s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeEntries := make([]*Entry, len(indexes))
+		for i := range indexes {
+			nodeEntries[i] = entries[indexes[i]]
+		}
+		nodeResult, err := node.SetNX(ctx, nodeEntries)
+		if err != nil {
+			return err
+		}
+		for i := range nodeResult {
+			result[indexes[i]] = nodeResult[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *ShardedStorage) Del(ctx context.Context, keys []string) error {
+	return s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		return node.Del(ctx, pickStrings(keys, indexes))
+	})
+}
+
+func (s *ShardedStorage) CompareAndDel(ctx context.Context, entries []*Entry) error {
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+	return s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeEntries := make([]*Entry, len(indexes))
+		for i := range indexes {
+			nodeEntries[i] = entries[indexes[i]]
+		}
+		return node.CompareAndDel(ctx, nodeEntries)
+	})
+}
+
+func (s *ShardedStorage) SAdd(ctx context.Context, key string, members []string, ttl time.Duration) error {
+	node, err := s.node(key)
+	if err != nil {
+		return err
+	}
+	return node.SAdd(ctx, key, members, ttl)
+}
+
+func (s *ShardedStorage) SMembers(ctx context.Context, key string) ([]string, error) {
+	node, err := s.node(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.SMembers(ctx, key)
+}
+
+func (s *ShardedStorage) SMembersMulti(ctx context.Context, keys []string) ([][]string, error) {
+	result := make([][]string, len(keys))
+	err := s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeResult, err := node.SMembersMulti(ctx, pickStrings(keys, indexes))
+		if err != nil {
+			return err
+		}
+		for i := range nodeResult {
+			result[indexes[i]] = nodeResult[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *ShardedStorage) SPopN(ctx context.Context, key string, count int64) ([]string, error) {
+	node, err := s.node(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.SPopN(ctx, key, count)
+}
+
+func (s *ShardedStorage) LPush(ctx context.Context, key string, values []string) error {
+	node, err := s.node(key)
+	if err != nil {
+		return err
+	}
+	return node.LPush(ctx, key, values)
+}
+
+func (s *ShardedStorage) LPushMulti(ctx context.Context, lists []*ListEntry) error {
+	keys := make([]string, len(lists))
+	for i := range lists {
+		keys[i] = lists[i].Key
+	}
+	return s.eachNode(ctx, keys, func(ctx context.Context, node IStorage, indexes []int) error {
+		nodeLists := make([]*ListEntry, len(indexes))
+		for i := range indexes {
+			nodeLists[i] = lists[indexes[i]]
+		}
+		return node.LPushMulti(ctx, nodeLists)
+	})
+}
+
+func (s *ShardedStorage) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	node, err := s.node(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.LRange(ctx, key, start, stop)
+}
+
+func (s *ShardedStorage) LTrim(ctx context.Context, key string, start, stop int64) error {
+	node, err := s.node(key)
+	if err != nil {
+		return err
+	}
+	return node.LTrim(ctx, key, start, stop)
+}
+
+func (s *ShardedStorage) LLen(ctx context.Context, key string) (int64, error) {
+	node, err := s.node(key)
+	if err != nil {
+		return 0, err
+	}
+	return node.LLen(ctx, key)
+}
+
+func (s *ShardedStorage) IncrBy(ctx context.Context, key string, value int64) (int64, error) {
+	node, err := s.node(key)
+	if err != nil {
+		return 0, err
+	}
+	return node.IncrBy(ctx, key, value)
+}
+
+//Publish sends messages through the node of channel, the node must be an IPubSub
+func (s *ShardedStorage) Publish(ctx context.Context, channel string, payload []byte) error {
+	node, err := s.node(channel)
+	if err != nil {
+		return err
+	}
+	pubSub, ok := node.(IPubSub)
+	if !ok {
+		return ErrPubSubUnsupported
+	}
+	return pubSub.Publish(ctx, channel, payload)
+}
+
+func (s *ShardedStorage) Subscribe(ctx context.Context, channel string) (<-chan *Message, error) {
+	node, err := s.node(channel)
+	if err != nil {
+		return nil, err
+	}
+	pubSub, ok := node.(IPubSub)
+	if !ok {
+		return nil, ErrPubSubUnsupported
+	}
+	return pubSub.Subscribe(ctx, channel)
+}
+
+//AddNode adds a storage node, keys moved to it are missing until they are saved again
+func (s *ShardedStorage) AddNode(name string, node IStorage) error {
+	s.Lock()
+	defer s.Unlock()
+	_, exists := s.nodes[name]
+	if exists {
+		return ErrDuplicateNode
+	}
+	s.nodes[name] = node
+	s.hash.Add(name)
+	return nil
+}
+
+//RemoveNode removes a storage node, keys on it are moved to other nodes
+func (s *ShardedStorage) RemoveNode(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	_, exists := s.nodes[name]
+	if !exists {
+		return ErrStorageNodeMissing
+	}
+	delete(s.nodes, name)
+	s.hash = newRendezvous(s.nodes)
+	return nil
+}
+
+func newRendezvous(nodes map[string]IStorage) *rendezvous.Rendezvous {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return rendezvous.New(names, xxhash.Sum64String)
+}
+
+func pickStrings(values []string, indexes []int) []string {
+	result := make([]string, len(indexes))
+	for i := range indexes {
+		result[i] = values[indexes[i]]
+	}
+	return result
+}
+
+//NewShardedStorage creates a storage over nodes, names of nodes decide where keys are,
+//so they must be stable, e.g. the address of redis
+func NewShardedStorage(nodes map[string]IStorage) *ShardedStorage {
+	s := &ShardedStorage{nodes: make(map[string]IStorage, len(nodes))}
+	for name := range nodes {
+		s.nodes[name] = nodes[name]
+	}
+	s.hash = newRendezvous(s.nodes)
+	return s
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestShardedStorage(t *testing.T) {
+	ctx := context.Background()
+	nodes := map[string]IStorage{
+		"node-1": NewMemoryStorage(),
+		"node-2": NewMemoryStorage(),
+		"node-3": NewMemoryStorage(),
+	}
+	s := NewShardedStorage(nodes)
+	keys := make([]string, 300)
+	entries := make([]*Entry, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%v", i)
+		entries[i] = &Entry{Key: keys[i], Value: []byte(keys[i])}
+	}
+	err := s.MSet(ctx, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := s.MGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if string(values[i]) != keys[i] {
+			t.Fatalf("unexpected value of %v: %q", keys[i], values[i])
+		}
+	}
+	for name, node := range nodes {
+		nodeValues, _ := node.MGet(ctx, keys)
+		count := 0
+		for i := range nodeValues {
+			if nodeValues[i] != nil {
+				count++
+			}
+		}
+		if count < 50 {
+			t.Fatalf("keys are not spread, %v has %v keys", name, count)
+		}
+	}
+
+	//adding a node only moves keys to the new node
+	err = s.AddNode("node-4", NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ = s.MGet(ctx, keys)
+	moved := 0
+	for i := range values {
+		if values[i] == nil {
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(keys)/2 {
+		t.Fatalf("unexpected moved keys: %v", moved)
+	}
+
+	//removing the new node moves its keys back
+	err = s.RemoveNode("node-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ = s.MGet(ctx, keys)
+	for i := range values {
+		if values[i] == nil {
+			t.Fatalf("%v should be back", keys[i])
+		}
+	}
+}
+
+func TestShardedStorageHashTag(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStorage(map[string]IStorage{
+		"node-1": NewMemoryStorage(),
+		"node-2": NewMemoryStorage(),
+	})
+	for i := 0; i < 20; i++ {
+		tag := fmt.Sprintf("{tag-%v}", i)
+		first, _ := s.node(tag + ":entry")
+		second, _ := s.node(tag + ":related")
+		if first != second {
+			t.Fatalf("keys of %v should be on the same node", tag)
+		}
+	}
+	_, err := NewShardedStorage(nil).MGet(ctx, []string{"a"})
+	if err != ErrNoStorageNode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestShardedStorageSMembersMulti(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStorage(map[string]IStorage{
+		"node-1": NewMemoryStorage(),
+		"node-2": NewMemoryStorage(),
+	})
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("set-%v", i)
+		if i%2 == 0 {
+			_ = s.SAdd(ctx, keys[i], []string{keys[i]}, 0)
+		}
+	}
+	sets, err := s.SMembersMulti(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sets {
+		if i%2 == 0 && (len(sets[i]) != 1 || sets[i][0] != keys[i]) || i%2 == 1 && sets[i] != nil {
+			t.Fatalf("unexpected members of %v: %v", keys[i], sets[i])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const (
+	clusterSlots = 16384
+)
+
+//keySlot returns the redis cluster hash slot of key
+func keySlot(key string) int {
+	return int(crc16(hashTag(key)) % clusterSlots)
+}
+
+//hashTag returns the part of key hashed by redis cluster,
+//it's the content of the first {...} if it's not empty, otherwise the whole key
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end < 1 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+//crc16 is CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(data string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(data); i++ {
+		crc = crc ^ uint16(data[i])<<8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return crc
+}
+
+//groupBySlot groups indexes of keys by hash slot in the order of keys
+func groupBySlot(keys []string) [][]int {
+	groups := make([][]int, 0)
+	slotGroups := make(map[int]int)
+	for i := range keys {
+		slot := keySlot(keys[i])
+		groupIndex, exists := slotGroups[slot]
+		if !exists {
+			groupIndex = len(groups)
+			slotGroups[slot] = groupIndex
+			groups = append(groups, nil)
+		}
+		groups[groupIndex] = append(groups[groupIndex], i)
+	}
+	return groups
+}
+
+//fanOut calls fn for every group in [0, count) in parallel and returns the first error
+func fanOut(ctx context.Context, count int, fn func(ctx context.Context, group int) error) error {
+	if count == 1 {
+		return fn(ctx, 0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(group int) {
+			defer wg.Done()
+			err := fn(ctx, group)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
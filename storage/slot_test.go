@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc16("123456789") != 0x31C3 {
+		t.Fatalf("unexpected crc16: %x", crc16("123456789"))
+	}
+	if keySlot("foo") != 12182 {
+		t.Fatalf("unexpected slot of foo: %v", keySlot("foo"))
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Fatal("keys with the same hash tag should be in the same slot")
+	}
+	if hashTag("foo{}{bar}") != "foo{}{bar}" || hashTag("foo{{bar}}") != "{bar" {
+		t.Fatalf("unexpected hash tags: %v, %v", hashTag("foo{}{bar}"), hashTag("foo{{bar}}"))
+	}
+}
+
+func TestGroupBySlot(t *testing.T) {
+	keys := []string{"{a}1", "{b}1", "{a}2", "{b}2", "{a}3"}
+	groups := groupBySlot(keys)
+	if len(groups) != 2 {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	if len(groups[0]) != 3 || groups[0][0] != 0 || groups[0][2] != 4 {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotInteger        = errors.New("value is not an integer")
+	ErrPubSubUnsupported = errors.New("storage doesn't support pub/sub")
+)
+
+type Entry struct {
+	Key   string
+	Value []byte
+	//TTL <= 0 means the entry never expires
+	TTL time.Duration
+	//Expected makes CompareAndWrite set the entry only if its current value equals Expected, Write ignores it
+	Expected []byte
+}
+
+//SetEntry adds Members to the set of Key
+type SetEntry struct {
+	Key     string
+	Members []string
+	//TTL <= 0 keeps the TTL of the set
+	TTL time.Duration
+}
+
+//ListEntry pushes Values to the head of the list of Key
+type ListEntry struct {
+	Key    string
+	Values []string
+}
+
+//Batch is a group of writes applied atomically
+type Batch struct {
+	Entries []*Entry
+	Sets    []*SetEntry
+}
+
+type IStorage interface {
+	//MGet returns values in the order of keys, missing keys are nil
+	MGet(ctx context.Context, keys []string) ([][]byte, error)
+	MSet(ctx context.Context, entries []*Entry) error
+	Del(ctx context.Context, keys []string) error
+	//SetNX sets entries which don't exist yet, the result reports which entries are set
+	SetNX(ctx context.Context, entries []*Entry) ([]bool, error)
+	//Write applies every write of batch with its TTL, either all of them or none
+	Write(ctx context.Context, batch *Batch) error
+	//CompareAndWrite applies batch like Write, except that entries with Expected are set only if
+	//their current values equal Expected, the result reports which entries are set
+	CompareAndWrite(ctx context.Context, batch *Batch) ([]bool, error)
+	//CompareAndDel deletes keys of entries only if their current values equal Value, TTL is ignored
+	CompareAndDel(ctx context.Context, entries []*Entry) error
+
+	SAdd(ctx context.Context, key string, members []string, ttl time.Duration) error
+	SMembers(ctx context.Context, key string) ([]string, error)
+	//SMembersMulti returns members of every set in the order of keys, missing sets are nil
+	SMembersMulti(ctx context.Context, keys []string) ([][]string, error)
+	SPopN(ctx context.Context, key string, count int64) ([]string, error)
+
+	LPush(ctx context.Context, key string, values []string) error
+	//LPushMulti pushes every list in one round trip, it isn't atomic
+	LPushMulti(ctx context.Context, lists []*ListEntry) error
+	LRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	LTrim(ctx context.Context, key string, start, stop int64) error
+	LLen(ctx context.Context, key string) (int64, error)
+
+	IncrBy(ctx context.Context, key string, value int64) (int64, error)
+}
+
+type Message struct {
+	Payload []byte
+	//Reset means messages may have been lost, e.g. the subscription was interrupted
+	Reset bool
+}
+
+//IPubSub is implemented by storages which can broadcast messages to every subscriber
+type IPubSub interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	//Subscribe delivers messages of channel until ctx is done, then closes the returned channel
+	Subscribe(ctx context.Context, channel string) (<-chan *Message, error)
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+func TestIndependentEngines(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	source1 := &typedRecordESource{records: map[string]*RecordEEntity{"e1": {ID: "e1", Title: "db1"}}}
+	source2 := &typedRecordESource{records: map[string]*RecordEEntity{"e1": {ID: "e1", Title: "db2"}}}
+	engine1 := cache.New(cache.WithStorage(s), cache.WithNamespace("db1"),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source1)))
+	engine2 := cache.New(cache.WithStorage(s), cache.WithNamespace("db2"),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source2)))
+
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine1, source1.Name(), []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEntries(t, s, []string{engine1.IDKey(source1.Name(), "e1")})
+
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine2, source2.Name(), []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "db2" {
+		t.Fatalf("engines should not share entries: %#v", records)
+	}
+	if engine1.IDKey(source1.Name(), "e1") == engine2.IDKey(source2.Name(), "e1") {
+		t.Fatal("engines should not share keys")
+	}
+}
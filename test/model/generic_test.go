@@ -0,0 +1,86 @@
+package model
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+type typedRecordESource struct {
+	records map[string]*RecordEEntity
+	calls   int32
+}
+
+func (s *typedRecordESource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	atomic.AddInt32(&s.calls, 1)
+	result := make([]*RecordEEntity, 0, len(ids))
+	for i := range ids {
+		if s.records[ids[i]] != nil {
+			result = append(result, s.records[ids[i]])
+		}
+	}
+	return result, nil
+}
+
+func (s *typedRecordESource) Name() string {
+	return "typed-querier-e"
+}
+
+//waitForEntries waits until keys hold values other than leases
+func waitForEntries(t *testing.T, s storage.IStorage, keys []string) {
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		values, err := s.MGet(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := true
+		for j := range values {
+			if values[j] == nil || codec.IsLease(values[j]) {
+				saved = false
+			}
+		}
+		if saved {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("entries not saved: %v", keys)
+}
+
+func TestTypedBatchGet(t *testing.T) {
+	ctx := context.Background()
+	source := &typedRecordESource{records: map[string]*RecordEEntity{
+		"e1": {ID: "e1", Title: "t1"},
+		"e2": {ID: "e2", Title: "t2"},
+	}}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordEEntity](source))
+
+	ids := []string{"e2", "e1", "e3"}
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, source.Name(), ids, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ID != "e2" || records[1].ID != "e1" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	waitForEntries(t, s, []string{engine.IDKey(source.Name(), "e1"), engine.IDKey(source.Name(), "e2")})
+
+	records, err = cache.BatchGet[*RecordEEntity](ctx, engine, source.Name(), []string{"e1", "e2"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Title != "t1" || records[1].Title != "t2" {
+		t.Fatalf("unexpected cached records: %#v", records)
+	}
+	if atomic.LoadInt32(&source.calls) != 1 {
+		t.Fatalf("data source should be queried once, got %v", source.calls)
+	}
+}
@@ -0,0 +1,145 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/keybuilder"
+	"github.com/KL-Engineering/kidsloop-cache/localcache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//newReplica returns an engine with its own local cache on shared storage, like an instance of a service
+func newReplica(s storage.IStorage) (*cache.CacheEngine, *localcache.LRUCache) {
+	source := &mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"}, "e2": {ID: "e2"},
+	}}
+	local := localcache.NewLRUCache(100, time.Minute)
+	engine := cache.New(cache.WithStorage(s), cache.WithLocalCache(local),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))
+	return engine, local
+}
+
+func waitForLocalMissing(t *testing.T, local localcache.ILocalCache, key string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := local.Get(key); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("local entry should be invalidated: %v", key)
+}
+
+func TestInvalidateReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storage.NewMemoryStorage()
+	engineA, _ := newReplica(s)
+	engineB, localB := newReplica(s)
+	events := make(chan *cache.InvalidationEvent, 10)
+	err := engineB.Subscribe(ctx, func(ctx context.Context, event *cache.InvalidationEvent) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.BatchGet[*RecordEEntity](ctx, engineB, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1 := engineB.IDKey(constant.QuerierE, "e1")
+	key2 := engineB.IDKey(constant.QuerierE, "e2")
+	waitForEntries(t, s, []string{key1, key2})
+	if _, ok := localB.Get(key1); !ok {
+		t.Fatalf("entry should be in local cache of B")
+	}
+
+	_, err = engineA.CleanAndReport(ctx, constant.QuerierE, []string{"e1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Flush || event.DataSourceName != constant.QuerierE || len(event.IDs) != 1 || event.IDs[0] != "e1" {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("invalidation event should be delivered to B")
+	}
+	waitForLocalMissing(t, localB, key1)
+	if _, ok := localB.Get(key2); !ok {
+		t.Fatalf("entries not cleaned should stay in local cache of B")
+	}
+}
+
+func TestInvalidateReplicasReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storage.NewMemoryStorage()
+	engine, local := newReplica(s)
+	//the handler blocks on the first event, so that later messages are dropped and a Reset follows
+	release := make(chan struct{})
+	flushed := make(chan struct{})
+	first := true
+	err := engine.Subscribe(ctx, func(ctx context.Context, event *cache.InvalidationEvent) {
+		if first {
+			first = false
+			<-release
+		}
+		if event.Flush {
+			close(flushed)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := engine.IDKey(constant.QuerierE, "e2")
+	waitForEntries(t, s, []string{key})
+
+	channel := keybuilder.New("").InvalidationChannel()
+	for i := 0; i < 200; i++ {
+		err = s.Publish(ctx, channel, []byte(`{"data_source":"","ids":[]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := local.Get(key); !ok {
+		t.Fatalf("entry should be in local cache before reset")
+	}
+	close(release)
+	//the Reset is delivered by the first publish with room in the buffer
+	for i := 0; i < 100; i++ {
+		err = s.Publish(ctx, channel, []byte(`{"data_source":"","ids":[]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-flushed:
+			if _, ok := local.Get(key); ok {
+				t.Fatalf("reset should purge the local cache")
+			}
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("reset should be delivered after messages were dropped")
+}
+
+func TestSubscribeUnsupported(t *testing.T) {
+	//the storage hides Publish and Subscribe of the memory storage
+	engine := cache.New(cache.WithStorage(struct{ storage.IStorage }{storage.NewMemoryStorage()}))
+	err := engine.Subscribe(context.Background(), nil)
+	if !errors.Is(err, storage.ErrPubSubUnsupported) || !errors.Is(err, cache.ErrPubSubUnsupported) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
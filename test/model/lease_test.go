@@ -0,0 +1,188 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//blockingSource reads the record, then blocks the first query until release is closed, later queries return at once
+type blockingSource struct {
+	sync.Mutex
+	record  *RecordEEntity
+	read    chan struct{}
+	release chan struct{}
+	blocked bool
+}
+
+func (s *blockingSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	s.Lock()
+	record := *s.record
+	first := !s.blocked
+	s.blocked = true
+	s.Unlock()
+	if first {
+		close(s.read)
+		<-s.release
+	}
+	return []*RecordEEntity{&record}, nil
+}
+
+func (s *blockingSource) Name() string {
+	return constant.QuerierE
+}
+
+func (s *blockingSource) update(title string) {
+	s.Lock()
+	defer s.Unlock()
+	s.record = &RecordEEntity{ID: s.record.ID, Title: title}
+}
+
+//leasedStorage reports saves guarded by leases
+type leasedStorage struct {
+	*storage.MemoryStorage
+	saved chan struct{}
+}
+
+func (s *leasedStorage) CompareAndWrite(ctx context.Context, batch *storage.Batch) ([]bool, error) {
+	written, err := s.MemoryStorage.CompareAndWrite(ctx, batch)
+	select {
+	case s.saved <- struct{}{}:
+	default:
+	}
+	return written, err
+}
+
+//raceCleanWithLoad cleans e1 after its old value is read from the data source and before it's saved
+func raceCleanWithLoad(t *testing.T, options ...cache.Option) (*cache.CacheEngine, *leasedStorage) {
+	return raceWithLoad(t, func(ctx context.Context, engine *cache.CacheEngine) error {
+		_, err := engine.CleanAndReport(ctx, constant.QuerierE, []string{"e1"})
+		return err
+	}, options...)
+}
+
+//raceWithLoad updates e1 and runs race after its old value is read from the data source and before it's saved
+func raceWithLoad(t *testing.T, race func(ctx context.Context, engine *cache.CacheEngine) error, options ...cache.Option) (*cache.CacheEngine, *leasedStorage) {
+	ctx := context.Background()
+	source := &blockingSource{
+		record:  &RecordEEntity{ID: "e1", Title: "old"},
+		read:    make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s := &leasedStorage{MemoryStorage: storage.NewMemoryStorage(), saved: make(chan struct{}, 1)}
+	engine := cache.New(append(options, cache.WithStorage(s), cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))...)
+	engine.SetDoubleDeleteDelay(ctx, constant.QuerierE, 0)
+
+	done := make(chan error)
+	go func() {
+		_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+		done <- err
+	}()
+	<-source.read
+	source.update("new")
+	err := race(ctx, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(source.release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, s
+}
+
+func TestLeasePreventsStaleWrite(t *testing.T) {
+	//leases are enabled by default
+	engine, s := raceCleanWithLoad(t)
+	//wait for the save of the old value
+	select {
+	case <-s.saved:
+	case <-time.After(time.Second):
+		t.Fatal("old value should be saved with its lease")
+	}
+
+	records, err := cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "new" {
+		t.Fatalf("stale object should not be saved after clean: %#v", records)
+	}
+}
+
+func TestStaleWriteWithoutLease(t *testing.T) {
+	engine, s := raceCleanWithLoad(t, cache.WithLeaseTTL(0))
+	waitForEntries(t, s, []string{engine.IDKey(constant.QuerierE, "e1")})
+
+	records, err := cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "old" {
+		t.Fatalf("without leases the stale object is saved: %#v", records)
+	}
+}
+
+func TestPassiveRefresherLeasesExpired(t *testing.T) {
+	ctx := context.Background()
+	//the source blocks only after the entry is filled
+	source := &blockingSource{
+		record:  &RecordEEntity{ID: "e1", Title: "old"},
+		read:    make(chan struct{}),
+		release: make(chan struct{}),
+		blocked: true,
+	}
+	s := &leasedStorage{MemoryStorage: storage.NewMemoryStorage(), saved: make(chan struct{}, 1)}
+	engine := cache.New(cache.WithStorage(s), cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))
+	engine.SetDoubleDeleteDelay(ctx, constant.QuerierE, 0)
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEntries(t, s, []string{engine.IDKey(constant.QuerierE, "e1")})
+	<-s.saved
+	source.Lock()
+	source.blocked = false
+	source.Unlock()
+
+	//the entry has no expire info, so the refresher reloads it as expired, and Clean runs during the reload
+	done := make(chan error)
+	go func() {
+		var records []*RecordEEntity
+		done <- cache.NewPassiveRefresher(engine).BatchGet(ctx, constant.QuerierE, []string{"e1"}, &records)
+	}()
+	<-source.read
+	select {
+	case <-s.saved:
+	case <-time.After(time.Second):
+		t.Fatal("expired entry should be replaced with a lease")
+	}
+	source.update("new")
+	_, err = engine.CleanAndReport(ctx, constant.QuerierE, []string{"e1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(source.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.saved:
+	case <-time.After(time.Second):
+		t.Fatal("old value should be saved with its lease")
+	}
+
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "new" {
+		t.Fatalf("stale object should not be saved after clean: %#v", records)
+	}
+}
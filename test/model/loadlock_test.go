@@ -0,0 +1,214 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//countingSource counts queries, a gated source closes started at the first query and blocks queries until release is closed
+type countingSource struct {
+	mapSource[*RecordEEntity]
+	started chan struct{}
+	release chan struct{}
+	queries int32
+}
+
+func (s *countingSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	if atomic.AddInt32(&s.queries, 1) == 1 && s.started != nil {
+		close(s.started)
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	return s.mapSource.QueryByIDs(ctx, ids, options...)
+}
+
+func (s *countingSource) count() int {
+	return int(atomic.LoadInt32(&s.queries))
+}
+
+func newCountingSource(gated bool) *countingSource {
+	source := &countingSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1", Title: "db"},
+	}}}
+	if gated {
+		source.started = make(chan struct{})
+		source.release = make(chan struct{})
+	}
+	return source
+}
+
+//releaseStorage reports load locks released
+type releaseStorage struct {
+	*storage.MemoryStorage
+	released chan struct{}
+}
+
+func (s *releaseStorage) CompareAndDel(ctx context.Context, entries []*storage.Entry) error {
+	err := s.MemoryStorage.CompareAndDel(ctx, entries)
+	s.released <- struct{}{}
+	return err
+}
+
+//refusedStorage runs refused once a SetNX doesn't take every key, i.e. a load lock is held by another instance
+type refusedStorage struct {
+	*storage.MemoryStorage
+	refused func()
+	once    sync.Once
+}
+
+func (s *refusedStorage) SetNX(ctx context.Context, entries []*storage.Entry) ([]bool, error) {
+	locked, err := s.MemoryStorage.SetNX(ctx, entries)
+	for i := range locked {
+		if !locked[i] {
+			s.once.Do(s.refused)
+			break
+		}
+	}
+	return locked, err
+}
+
+//newLockedInstance returns an engine with load locks on shared storage, like an instance of a service
+func newLockedInstance(s storage.IStorage, source cache.IDataSource, lease time.Duration, wait time.Duration) *cache.CacheEngine {
+	return cache.New(cache.WithStorage(s), cache.WithLoadLock(lease, wait), cache.WithDataSources(source))
+}
+
+func TestLoadLockWaiterReadsEntry(t *testing.T) {
+	ctx := context.Background()
+	sourceA := newCountingSource(true)
+	sourceB := newCountingSource(false)
+	//A holds the lock until B finds it taken
+	s := &refusedStorage{MemoryStorage: storage.NewMemoryStorage(), refused: func() {
+		close(sourceA.release)
+	}}
+	engineA := newLockedInstance(s, cache.NewDataSource[*RecordEEntity](sourceA), time.Second, time.Second)
+	engineB := newLockedInstance(s, cache.NewDataSource[*RecordEEntity](sourceB), time.Second, time.Second)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.BatchGet[*RecordEEntity](ctx, engineA, constant.QuerierE, []string{"e1"}, time.Minute)
+		done <- err
+	}()
+	<-sourceA.started
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engineB, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "db" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	if sourceA.count() != 1 || sourceB.count() != 0 {
+		t.Fatalf("waiter should read the entry filled by the lock holder: %v, %v", sourceA.count(), sourceB.count())
+	}
+}
+
+func TestLoadLockWaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	source := newCountingSource(false)
+	engine := newLockedInstance(s, cache.NewDataSource[*RecordEEntity](source), time.Second, time.Millisecond*100)
+	//another instance holds the lock and never fills the entry
+	lockKey := engine.LoadLockKey(constant.QuerierE, "e1")
+	err := s.MSet(ctx, []*storage.Entry{{Key: lockKey, Value: []byte("other"), TTL: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || source.count() != 1 {
+		t.Fatalf("waiter should load from data source after the wait: %#v, %v", records, source.count())
+	}
+	if time.Since(start) < time.Millisecond*100 {
+		t.Fatalf("waiter should wait for the lock holder: %v", time.Since(start))
+	}
+	waitForEntries(t, s, []string{engine.IDKey(constant.QuerierE, "e1")})
+	values, err := s.MGet(ctx, []string{lockKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "other" {
+		t.Fatalf("lock of another instance mustn't be released: %q", values[0])
+	}
+}
+
+func TestLoadLockReleasedOnError(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStorage()
+	source := &failingSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE}, failID: "e1"}
+	engine := newLockedInstance(s, cache.NewDataSource[*RecordEEntity](source), time.Minute, time.Second)
+
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if !errors.Is(err, errSegment) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values, err := s.MGet(ctx, []string{engine.LoadLockKey(constant.QuerierE, "e1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != nil {
+		t.Fatalf("lock should be released after the load failed: %q", values[0])
+	}
+}
+
+func TestLoadLockExpired(t *testing.T) {
+	ctx := context.Background()
+	s := &releaseStorage{MemoryStorage: storage.NewMemoryStorage(), released: make(chan struct{}, 1)}
+	source := newCountingSource(true)
+	engine := newLockedInstance(s, cache.NewDataSource[*RecordEEntity](source), time.Millisecond*20, time.Second)
+	lockKey := engine.LoadLockKey(constant.QuerierE, "e1")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+		done <- err
+	}()
+	//the lock expires during the load and another instance takes it
+	<-source.started
+	takeExpiredLock(t, s, lockKey)
+	close(source.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.released:
+	case <-time.After(time.Second):
+		t.Fatal("lock should be released after saving")
+	}
+	values, err := s.MGet(ctx, []string{lockKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "other" {
+		t.Fatalf("lock taken by another instance mustn't be released: %q", values[0])
+	}
+}
+
+//takeExpiredLock takes the lock as another instance once the lock of the loading instance expires
+func takeExpiredLock(t *testing.T, s storage.IStorage, lockKey string) {
+	for i := 0; i < 100; i++ {
+		locked, err := s.SetNX(context.Background(), []*storage.Entry{{Key: lockKey, Value: []byte("other"), TTL: time.Minute}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked[0] {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("expired lock should be taken")
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/localcache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//hookStorage runs the hook once after the next MGet has read storage
+type hookStorage struct {
+	*storage.MemoryStorage
+	mutex sync.Mutex
+	hook  func()
+	reads int
+}
+
+func (s *hookStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	values, err := s.MemoryStorage.MGet(ctx, keys)
+	s.mutex.Lock()
+	s.reads++
+	hook := s.hook
+	s.hook = nil
+	s.mutex.Unlock()
+	if hook != nil {
+		hook()
+	}
+	return values, err
+}
+
+func (s *hookStorage) setHook(hook func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hook = hook
+}
+
+func (s *hookStorage) readCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reads
+}
+
+func setupLocalCache(t *testing.T) (*cache.CacheEngine, *hookStorage, *localcache.LRUCache) {
+	ctx := context.Background()
+	source := &mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1", Title: "old"},
+	}}
+	s := &hookStorage{MemoryStorage: storage.NewMemoryStorage()}
+	local := localcache.NewLRUCache(100, time.Minute)
+	engine := cache.New(cache.WithStorage(s), cache.WithLocalCache(local),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))
+
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEntries(t, s, []string{engine.IDKey(constant.QuerierE, "e1")})
+	return engine, s, local
+}
+
+func TestLocalCacheHit(t *testing.T) {
+	ctx := context.Background()
+	engine, s, local := setupLocalCache(t)
+	key := engine.IDKey(constant.QuerierE, "e1")
+	local.Purge()
+
+	//the first read fills the local cache, the second one doesn't read storage
+	for i := 0; i < 2; i++ {
+		records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Title != "old" {
+			t.Fatalf("unexpected records: %#v", records)
+		}
+	}
+	reads := s.readCount()
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.readCount() != reads {
+		t.Fatalf("entry should be read from local cache")
+	}
+
+	_, err = engine.CleanAndReport(ctx, constant.QuerierE, []string{"e1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := local.Get(key); ok {
+		t.Fatalf("clean should delete the local entry")
+	}
+}
+
+func TestLocalCacheFillAfterClean(t *testing.T) {
+	ctx := context.Background()
+	engine, s, local := setupLocalCache(t)
+	key := engine.IDKey(constant.QuerierE, "e1")
+	local.Purge()
+
+	//clean runs between reading storage and filling the local cache
+	s.setHook(func() {
+		_, err := engine.CleanAndReport(ctx, constant.QuerierE, []string{"e1"})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := local.Get(key); ok {
+		t.Fatalf("value read before clean mustn't be put into local cache")
+	}
+}
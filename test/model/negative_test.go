@@ -0,0 +1,60 @@
+package model
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+)
+
+func TestNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	source := &typedRecordESource{records: map[string]*RecordEEntity{
+		"e1": {ID: "e1", Title: "t1"},
+	}}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordEEntity](source))
+	engine.SetNegativeExpire(ctx, source.Name(), time.Minute)
+	engine.SetDoubleDeleteDelay(ctx, source.Name(), 0)
+
+	ids := []string{"e1", "e9"}
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, source.Name(), ids, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != "e1" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	waitForEntries(t, s, []string{engine.IDKey(source.Name(), "e1"), engine.IDKey(source.Name(), "e9")})
+	values, _ := s.MGet(ctx, []string{engine.IDKey(source.Name(), "e9")})
+	if !codec.IsTombstone(values[0]) {
+		t.Fatalf("e9 should be a tombstone: %q", values[0])
+	}
+
+	records, err = cache.BatchGet[*RecordEEntity](ctx, engine, source.Name(), ids, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || atomic.LoadInt32(&source.calls) != 1 {
+		t.Fatalf("e9 should not be queried again, records: %#v, calls: %v", records, source.calls)
+	}
+
+	//the id is queried again after it's cleaned
+	source.records["e9"] = &RecordEEntity{ID: "e9", Title: "t9"}
+	_, err = engine.CleanAndReport(ctx, source.Name(), []string{"e9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = cache.BatchGet[*RecordEEntity](ctx, engine, source.Name(), ids, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Title != "t9" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+}
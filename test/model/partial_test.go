@@ -0,0 +1,121 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+var errSegment = errors.New("segment failed")
+
+//failingSource fails every query containing failID
+type failingSource struct {
+	mapSource[*RecordEEntity]
+	failID string
+}
+
+func (s *failingSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	for i := range ids {
+		if ids[i] == s.failID {
+			return nil, errSegment
+		}
+	}
+	return s.mapSource.QueryByIDs(ctx, ids, options...)
+}
+
+func setupFailingSource() (*cache.CacheEngine, storage.IStorage) {
+	ctx := context.Background()
+	source := &failingSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"}, "e2": {ID: "e2"}, "e3": {ID: "e3"}, "e4": {ID: "e4"},
+	}}, failID: "e3"}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSourceWithPolicy(ctx, cache.NewDataSource[*RecordEEntity](source), &cache.DataSourcePolicy{
+		SegmentSize:    2,
+		NegativeExpire: time.Minute,
+	})
+	return engine, s
+}
+
+func TestBatchGetError(t *testing.T) {
+	engine, _ := setupFailingSource()
+	_, err := cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1", "e2", "e3"}, time.Minute)
+	if !errors.Is(err, errSegment) {
+		t.Fatalf("error of data source should be returned: %v", err)
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	engine, s := setupFailingSource()
+	ctx := cache.WithPartialResults(context.Background())
+	ids := []string{"e1", "e2", "e3", "e4", "e5"}
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, ids, time.Minute)
+	partialErr, ok := err.(*cache.PartialResultError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 || records[0].ID != "e1" || records[1].ID != "e2" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	failed := partialErr.FailedIDs(cache.FailureDataSource)
+	sort.Strings(failed)
+	if len(failed) != 2 || failed[0] != "e3" || failed[1] != "e4" {
+		t.Fatalf("unexpected failed ids: %v", failed)
+	}
+	missing := partialErr.FailedIDs(cache.FailureMissing)
+	if len(missing) != 1 || missing[0] != "e5" {
+		t.Fatalf("unexpected missing ids: %v", missing)
+	}
+	for i := range partialErr.Failures {
+		if partialErr.Failures[i].Reason == cache.FailureDataSource && partialErr.Failures[i].Err != errSegment {
+			t.Fatalf("unexpected failure: %#v", partialErr.Failures[i])
+		}
+	}
+
+	//ids failed aren't saved as tombstones, only the leases taken before loading them are left until they expire
+	waitForEntries(t, s, idKeys(engine, constant.QuerierE, []string{"e1", "e2", "e5"}))
+	values, err := s.MGet(context.Background(), idKeys(engine, constant.QuerierE, []string{"e3", "e4"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if !codec.IsLease(values[i]) {
+			t.Fatalf("failed ids should not be saved: %q", values[i])
+		}
+	}
+}
+
+func TestPartialResultsCacheDecode(t *testing.T) {
+	engine, s := setupFailingSource()
+	err := s.MSet(context.Background(), []*storage.Entry{
+		{Key: engine.IDKey(constant.QuerierE, "e2"), Value: []byte("{broken"), TTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if err == nil {
+		t.Fatal("decode error should be returned")
+	}
+
+	ctx := cache.WithPartialResults(context.Background())
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	partialErr, ok := err.(*cache.PartialResultError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].ID != "e1" {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	failed := partialErr.FailedIDs()
+	if len(failed) != 1 || failed[0] != "e2" || partialErr.Failures[0].Reason != cache.FailureCacheDecode {
+		t.Fatalf("unexpected failures: %v", partialErr)
+	}
+}
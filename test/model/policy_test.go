@@ -0,0 +1,91 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//segmentSource records the number of ids of every query
+type segmentSource struct {
+	mapSource[*RecordEEntity]
+	sync.Mutex
+	segments []int
+}
+
+func (s *segmentSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	s.Lock()
+	s.segments = append(s.segments, len(ids))
+	s.Unlock()
+	return s.mapSource.QueryByIDs(ctx, ids, options...)
+}
+
+func newSegmentSource() *segmentSource {
+	return &segmentSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"}, "e2": {ID: "e2"}, "e3": {ID: "e3"}, "e4": {ID: "e4"}, "e5": {ID: "e5"},
+	}}}
+}
+
+func TestDataSourcePolicy(t *testing.T) {
+	ctx := context.Background()
+	ids := []string{"e1", "e2", "e3", "e4", "e5"}
+	source := newSegmentSource()
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s), cache.WithDataSourcePolicy(constant.QuerierE, &cache.DataSourcePolicy{
+		SegmentSize: 2,
+		MaxExpire:   time.Minute,
+	}))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordEEntity](source))
+
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, ids, cache.InfiniteExpire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(ids) {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	if len(source.segments) != 3 {
+		t.Fatalf("ids should be queried in segments of 2: %v", source.segments)
+	}
+	for i := range source.segments {
+		if source.segments[i] > 2 {
+			t.Fatalf("ids should be queried in segments of 2: %v", source.segments)
+		}
+	}
+	waitForEntries(t, s, idKeys(engine, constant.QuerierE, ids))
+	if policy := engine.DataSourcePolicy(constant.QuerierE); policy.SegmentSize != 2 || policy.MaxExpire != time.Minute {
+		t.Fatalf("unexpected policy: %#v", policy)
+	}
+}
+
+func TestDisabledDataSource(t *testing.T) {
+	ctx := context.Background()
+	ids := []string{"e1", "e2"}
+	source := newSegmentSource()
+	s := &hookStorage{MemoryStorage: storage.NewMemoryStorage()}
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSourceWithPolicy(ctx, cache.NewDataSource[*RecordEEntity](source), &cache.DataSourcePolicy{Disabled: true})
+
+	for i := 0; i < 2; i++ {
+		records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, ids, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(ids) {
+			t.Fatalf("unexpected records: %#v", records)
+		}
+	}
+	if len(source.segments) != 2 {
+		t.Fatalf("disabled data source should be queried every time: %v", source.segments)
+	}
+	//a disabled data source never touches the cache, so no save is left running
+	if s.readCount() != 0 {
+		t.Fatalf("disabled data source shouldn't read the cache: %v", s.readCount())
+	}
+	assertMissing(t, s, idKeys(engine, constant.QuerierE, ids))
+}
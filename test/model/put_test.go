@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/codec"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+func entryTitle(t *testing.T, s storage.IStorage, key string) string {
+	values, err := s.MGet(context.Background(), []string{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] == nil {
+		return ""
+	}
+	record := new(RecordEEntity)
+	err = codec.Decode(values[0], record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.Title
+}
+
+func TestPut(t *testing.T) {
+	ctx := context.Background()
+	engine, s, keys := setupRelatedChain(t)
+
+	err := engine.Put(ctx, constant.QuerierE, []cache.Object{&RecordEEntity{ID: "e1", Title: "put"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := entryTitle(t, s, keys[3]); title != "put" {
+		t.Fatalf("object should be written: %q", title)
+	}
+	//objects embedding e1 are cleaned, e1 still knows them
+	assertMissing(t, s, keys[:3])
+	waitForMembers(t, s, engine.RelatedIDKey(constant.QuerierE, "e1"), 1)
+
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Title != "put" {
+		t.Fatalf("object put should be read from cache: %#v", records)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	source := &mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1", Title: "old"},
+		"e2": {ID: "e2", Title: "old"},
+	}}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s), cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))
+	engine.SetDoubleDeleteDelay(ctx, constant.QuerierE, 0)
+	keys := idKeys(engine, constant.QuerierE, []string{"e1", "e2"})
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEntries(t, s, keys)
+
+	source.records["e1"] = &RecordEEntity{ID: "e1", Title: "new"}
+	delete(source.records, "e2")
+	err = engine.Refresh(ctx, constant.QuerierE, []string{"e1", "e2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := entryTitle(t, s, keys[0]); title != "new" {
+		t.Fatalf("object should be reloaded: %q", title)
+	}
+	assertMissing(t, s, keys[1:])
+}
+
+func TestRefreshWithLoad(t *testing.T) {
+	//the load read the old object before Refresh, its save is dropped since Refresh replaced its lease
+	engine, s := raceWithLoad(t, func(ctx context.Context, engine *cache.CacheEngine) error {
+		return engine.Refresh(ctx, constant.QuerierE, []string{"e1"})
+	}, cache.WithLeaseTTL(cache.DefaultLeaseTTL))
+	select {
+	case <-s.saved:
+	case <-time.After(time.Second):
+		t.Fatal("old object should be saved with its lease")
+	}
+	if title := entryTitle(t, s, engine.IDKey(constant.QuerierE, "e1")); title != "new" {
+		t.Fatalf("object refreshed should be kept: %q", title)
+	}
+}
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+type mapSource[T cache.Object] struct {
+	name    string
+	records map[string]T
+}
+
+func (s *mapSource[T]) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]T, error) {
+	result := make([]T, 0, len(ids))
+	for i := range ids {
+		record, exists := s.records[ids[i]]
+		if exists {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+func (s *mapSource[T]) Name() string {
+	return s.name
+}
+
+//assertMissing checks keys are deleted, cleans are done before returning so it doesn't wait
+func assertMissing(t *testing.T, s storage.IStorage, keys []string) {
+	values, err := s.MGet(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if values[i] != nil {
+			t.Fatalf("entry should be cleaned: %v", keys[i])
+		}
+	}
+}
+
+func waitForMembers(t *testing.T, s storage.IStorage, key string, count int) {
+	for i := 0; i < 100; i++ {
+		members, err := s.SMembers(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(members) == count {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("related members not saved: %v", key)
+}
+
+//setupRelatedChain caches a1 -> b1 -> d1 -> e1, a1 embeds d1 too
+func setupRelatedChain(t *testing.T) (*cache.CacheEngine, storage.IStorage, []string) {
+	ctx := context.Background()
+	sourceA := &mapSource[*RecordAEntity]{name: constant.QuerierA, records: map[string]*RecordAEntity{
+		"a1": {ID: "a1", BID: "b1", CID: "c1", DID: "d1"},
+	}}
+	sourceB := &mapSource[*RecordBEntity]{name: constant.QuerierB, records: map[string]*RecordBEntity{
+		"b1": {ID: "b1", DID: "d1"},
+	}}
+	sourceD := &mapSource[*RecordDEntity]{name: constant.QuerierD, records: map[string]*RecordDEntity{
+		"d1": {ID: "d1", EID: "e1"},
+	}}
+	sourceE := &mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"},
+	}}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordAEntity](sourceA))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordBEntity](sourceB))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordDEntity](sourceD))
+	engine.AddDataSource(ctx, cache.NewDataSource[*RecordEEntity](sourceE))
+	for _, name := range []string{constant.QuerierA, constant.QuerierB, constant.QuerierD, constant.QuerierE} {
+		engine.SetDoubleDeleteDelay(ctx, name, 0)
+	}
+
+	var err error
+	_, err = cache.BatchGet[*RecordAEntity](ctx, engine, constant.QuerierA, []string{"a1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.BatchGet[*RecordBEntity](ctx, engine, constant.QuerierB, []string{"b1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.BatchGet[*RecordDEntity](ctx, engine, constant.QuerierD, []string{"d1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{
+		engine.IDKey(constant.QuerierA, "a1"),
+		engine.IDKey(constant.QuerierB, "b1"),
+		engine.IDKey(constant.QuerierD, "d1"),
+		engine.IDKey(constant.QuerierE, "e1"),
+	}
+	waitForEntries(t, s, keys)
+	waitForMembers(t, s, engine.RelatedIDKey(constant.QuerierB, "b1"), 1)
+	waitForMembers(t, s, engine.RelatedIDKey(constant.QuerierD, "d1"), 2)
+	waitForMembers(t, s, engine.RelatedIDKey(constant.QuerierE, "e1"), 1)
+	return engine, s, keys
+}
+
+func TestCleanRelatedChain(t *testing.T) {
+	ctx := context.Background()
+	engine, s, keys := setupRelatedChain(t)
+
+	engine.Clean(ctx, constant.QuerierE, []string{"e1"})
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err := engine.WaitPendingDeletes(waitCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, keys)
+}
+
+func TestCleanLegacyRelatedMembers(t *testing.T) {
+	ctx := context.Background()
+	engine, s, keys := setupRelatedChain(t)
+
+	//replace the related set of b1 with a plain id as old versions do
+	relatedKey := engine.RelatedIDKey(constant.QuerierB, "b1")
+	err := s.Del(ctx, []string{relatedKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SAdd(ctx, relatedKey, []string{"a1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.Clean(ctx, constant.QuerierB, []string{"b1"})
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err = engine.WaitPendingDeletes(waitCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, keys[:2])
+	waitForEntries(t, s, keys[2:])
+}
+
+//declaredSource declares data sources whose objects its objects embed
+type declaredSource struct {
+	mapSource[*linkedRecord]
+	related []string
+}
+
+func (s *declaredSource) RelatedDataSources() []string {
+	return s.related
+}
+
+func TestCleanLegacyMembersOfDeclaredSources(t *testing.T) {
+	ctx := context.Background()
+	owner, embedder, other := "legacy-owner", "legacy-embedder", "legacy-other"
+	newSource := func(name string, related ...string) *declaredSource {
+		return &declaredSource{mapSource: mapSource[*linkedRecord]{name: name, records: map[string]*linkedRecord{
+			"u1": {ID: "u1", Source: name},
+		}}, related: related}
+	}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSource(ctx, cache.NewDataSource[*linkedRecord](newSource(owner)))
+	engine.AddDataSource(ctx, cache.NewDataSource[*linkedRecord](newSource(embedder, owner)))
+	engine.AddDataSource(ctx, cache.NewDataSource[*linkedRecord](newSource(other, embedder)))
+	keys := make([]string, 0, 3)
+	for _, name := range []string{owner, embedder, other} {
+		engine.SetDoubleDeleteDelay(ctx, name, 0)
+		_, err := cache.BatchGet[*linkedRecord](ctx, engine, name, []string{"u1"}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, engine.IDKey(name, "u1"))
+	}
+	waitForEntries(t, s, keys)
+
+	//a plain id as old versions saved, only data sources declaring the owner may embed it
+	err := s.SAdd(ctx, engine.RelatedIDKey(owner, "u1"), []string{"u1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.CleanAndReport(ctx, owner, []string{"u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, keys[:2])
+	waitForEntries(t, s, keys[2:])
+}
+
+type linkedRecord struct {
+	ID      string `json:"id"`
+	Source  string `json:"source"`
+	LinkIDs []string
+}
+
+func (r *linkedRecord) StringID() string {
+	return r.ID
+}
+
+func (r *linkedRecord) RelatedIDs() []*cache.RelatedEntity {
+	return []*cache.RelatedEntity{{DataSourceName: r.Source, RelatedIDs: r.LinkIDs}}
+}
+
+func idKeys(engine *cache.CacheEngine, name string, ids []string) []string {
+	keys := make([]string, len(ids))
+	for i := range ids {
+		keys[i] = engine.IDKey(name, ids[i])
+	}
+	return keys
+}
+
+//setupLinkedRecords caches records of a single data source, each record embeds records of LinkIDs
+func setupLinkedRecords(t *testing.T, name string, links map[string][]string) (*cache.CacheEngine, storage.IStorage) {
+	ctx := context.Background()
+	source := &mapSource[*linkedRecord]{name: name, records: map[string]*linkedRecord{}}
+	ids := make([]string, 0, len(links))
+	for id, linkIDs := range links {
+		source.records[id] = &linkedRecord{ID: id, Source: name, LinkIDs: linkIDs}
+		ids = append(ids, id)
+	}
+	s := storage.NewMemoryStorage()
+	engine := cache.New(cache.WithStorage(s))
+	engine.AddDataSource(ctx, cache.NewDataSource[*linkedRecord](source))
+	engine.SetDoubleDeleteDelay(ctx, name, 0)
+	_, err := cache.BatchGet[*linkedRecord](ctx, engine, name, ids, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEntries(t, s, idKeys(engine, name, ids))
+	return engine, s
+}
+
+func TestCleanCyclicRelations(t *testing.T) {
+	ctx := context.Background()
+	name := "linked-cyclic"
+	engine, s := setupLinkedRecords(t, name, map[string][]string{
+		"x": {"y"},
+		"y": {"x"},
+	})
+	waitForMembers(t, s, engine.RelatedIDKey(name, "x"), 1)
+	waitForMembers(t, s, engine.RelatedIDKey(name, "y"), 1)
+
+	report, err := engine.CleanAndReport(ctx, name, []string{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attempted[name] != 2 || report.Truncated {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+	assertMissing(t, s, idKeys(engine, name, []string{"x", "y"}))
+}
+
+func TestCleanMaxDepth(t *testing.T) {
+	ctx := context.Background()
+	name := "linked-chain"
+	//n3 embeds n2, n2 embeds n1, n1 embeds n0
+	engine, s := setupLinkedRecords(t, name, map[string][]string{
+		"n0": nil,
+		"n1": {"n0"},
+		"n2": {"n1"},
+		"n3": {"n2"},
+	})
+	waitForMembers(t, s, engine.RelatedIDKey(name, "n2"), 1)
+	engine.SetMaxCleanDepth(ctx, name, 1)
+
+	report, err := engine.CleanAndReport(ctx, name, []string{"n0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attempted[name] != 2 || report.Depth != 1 || !report.Truncated {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+	assertMissing(t, s, idKeys(engine, name, []string{"n0", "n1"}))
+	waitForEntries(t, s, idKeys(engine, name, []string{"n2", "n3"}))
+
+	//related sets beyond the max depth are kept for later cleans
+	engine.SetMaxCleanDepth(ctx, name, cache.DefaultMaxCleanDepth)
+	report, err = engine.CleanAndReport(ctx, name, []string{"n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attempted[name] != 3 {
+		t.Fatalf("unexpected report: %#v", report)
+	}
+	assertMissing(t, s, idKeys(engine, name, []string{"n2", "n3"}))
+}
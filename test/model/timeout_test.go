@@ -0,0 +1,170 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/kidsloop-cache/cache"
+	"github.com/KL-Engineering/kidsloop-cache/storage"
+	"github.com/KL-Engineering/kidsloop-cache/test/constant"
+)
+
+//slowStorage blocks MGet until delay passes or ctx is done
+type slowStorage struct {
+	*storage.MemoryStorage
+	delay time.Duration
+}
+
+func (s *slowStorage) MGet(ctx context.Context, keys []string) ([][]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	return s.MemoryStorage.MGet(ctx, keys)
+}
+
+//slowSource blocks QueryByIDs until delay passes or ctx is done
+type slowSource struct {
+	mapSource[*RecordEEntity]
+	delay time.Duration
+}
+
+func (s *slowSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	return s.mapSource.QueryByIDs(ctx, ids, options...)
+}
+
+func newSlowSource(delay time.Duration) *slowSource {
+	return &slowSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"}, "e2": {ID: "e2"},
+	}}, delay: delay}
+}
+
+func TestCacheReadTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := &slowStorage{MemoryStorage: storage.NewMemoryStorage(), delay: time.Second}
+	engine := cache.New(cache.WithStorage(s), cache.WithCacheTimeout(time.Millisecond*20, 0),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](newSlowSource(0))))
+
+	start := time.Now()
+	records, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("slow cache read should fall back to data source: %v", time.Since(start))
+	}
+}
+
+func TestDataSourceTimeout(t *testing.T) {
+	ctx := context.Background()
+	engine := cache.New(cache.WithStorage(storage.NewMemoryStorage()), cache.WithDataSourceTimeout(time.Millisecond*20),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](newSlowSource(time.Second))))
+
+	start := time.Now()
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("data source load should be limited: %v", time.Since(start))
+	}
+}
+
+func TestCallerDeadline(t *testing.T) {
+	engine := cache.New(cache.WithStorage(storage.NewMemoryStorage()),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](newSlowSource(time.Second))))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cache.BatchGet[*RecordEEntity](ctx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("deadline of caller should be honoured: %v", time.Since(start))
+	}
+}
+
+//gateSource reports the ids of every query, queries of e1 block until release is closed
+type gateSource struct {
+	mapSource[*RecordEEntity]
+	queries chan []string
+	release chan struct{}
+}
+
+func (s *gateSource) QueryByIDs(ctx context.Context, ids []string, options ...interface{}) ([]*RecordEEntity, error) {
+	s.queries <- ids
+	if ids[0] == "e1" {
+		<-s.release
+	}
+	return s.mapSource.QueryByIDs(ctx, ids, options...)
+}
+
+func TestCoalescedCallerDeadlines(t *testing.T) {
+	source := &gateSource{mapSource: mapSource[*RecordEEntity]{name: constant.QuerierE, records: map[string]*RecordEEntity{
+		"e1": {ID: "e1"}, "e2": {ID: "e2"}, "e3": {ID: "e3"},
+	}}, queries: make(chan []string, 2), release: make(chan struct{})}
+	engine := cache.New(cache.WithStorage(storage.NewMemoryStorage()),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](source)))
+
+	//the caller starting the load leaves at its deadline, the load is still shared with the other caller
+	shortCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	shortErr := make(chan error, 1)
+	go func() {
+		_, err := cache.BatchGet[*RecordEEntity](shortCtx, engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+		shortErr <- err
+	}()
+	<-source.queries
+	go func() {
+		//e3 is queried after the other caller joins the load of e1 and e2
+		<-source.queries
+		if err := <-shortErr; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error of short deadline: %v", err)
+		}
+		close(source.release)
+	}()
+	records, err := cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1", "e2", "e3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+}
+
+func TestCoalescedDataSourceTimeout(t *testing.T) {
+	engine := cache.New(cache.WithStorage(storage.NewMemoryStorage()), cache.WithDataSourceTimeout(time.Millisecond*50),
+		cache.WithDataSources(cache.NewDataSource[*RecordEEntity](newSlowSource(time.Second))))
+
+	//callers without deadlines share a load limited by the data source timeout
+	start := time.Now()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cache.BatchGet[*RecordEEntity](context.Background(), engine, constant.QuerierE, []string{"e1", "e2"}, time.Minute)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("shared load should be limited: %v", time.Since(start))
+	}
+}
@@ -1,6 +1,13 @@
 package utils
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
 
 //Transaction in batches, groups of segment
 func SegmentLoop(ctx context.Context, arrayLength, segment int, handler func(start, end int) error) error {
@@ -21,3 +28,93 @@ func SegmentLoop(ctx context.Context, arrayLength, segment int, handler func(sta
 	}
 	return nil
 }
+
+//SegmentError is the error of the segment [Start, End)
+type SegmentError struct {
+	Start int
+	End   int
+	Err   error
+}
+
+//SegmentErrors are errors of segments in the order of segments
+type SegmentErrors []*SegmentError
+
+func (s SegmentErrors) Error() string {
+	messages := make([]string, len(s))
+	for i := range s {
+		messages[i] = fmt.Sprintf("segment [%v, %v): %v", s[i].Start, s[i].End, s[i].Err)
+	}
+	return strings.Join(messages, "; ")
+}
+
+//Is reports whether any error of segments is target
+func (s SegmentErrors) Is(target error) bool {
+	for i := range s {
+		if errors.Is(s[i].Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//ParallelSegmentLoop runs handler on segments with at most parallelism segments at a time,
+//the first error cancels the ctx of outstanding segments and no more segments are started,
+//errors of segments are returned as SegmentErrors
+func ParallelSegmentLoop(ctx context.Context, arrayLength, segment, parallelism int, handler func(ctx context.Context, start, end int) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	loopCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(SegmentErrors, 0)
+	tokens := make(chan struct{}, parallelism)
+	started := 0
+	for start := 0; start < arrayLength; start = start + segment {
+		select {
+		case <-loopCtx.Done():
+		case tokens <- struct{}{}:
+		}
+		if loopCtx.Err() != nil {
+			break
+		}
+		end := start + segment
+		if end > arrayLength {
+			end = arrayLength
+		}
+		started = end
+		wg.Add(1)
+		go func(start, end int) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			err := handler(loopCtx, start, end)
+			if err == nil {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			//segments cancelled after the first error aren't errors of their own
+			if len(errs) > 0 && errors.Is(err, context.Canceled) {
+				return
+			}
+			errs = append(errs, &SegmentError{Start: start, End: end, Err: err})
+			cancel()
+		}(start, end)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool {
+			return errs[i].Start < errs[j].Start
+		})
+		return errs
+	}
+	if started < arrayLength {
+		return ctx.Err()
+	}
+	return nil
+}
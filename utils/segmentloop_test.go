@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelSegmentLoop(t *testing.T) {
+	var running, maxRunning int32
+	var mutex sync.Mutex
+	segments := make(map[int]int)
+	err := ParallelSegmentLoop(context.Background(), 10, 3, 2, func(ctx context.Context, start, end int) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mutex.Lock()
+		segments[start] = end
+		if current > maxRunning {
+			maxRunning = current
+		}
+		mutex.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 || segments[0] != 3 || segments[9] != 10 {
+		t.Fatalf("unexpected segments: %v", segments)
+	}
+	if maxRunning != 2 {
+		t.Fatalf("segments should run 2 at a time: %v", maxRunning)
+	}
+}
+
+func TestParallelSegmentLoopError(t *testing.T) {
+	errSegment := errors.New("segment failed")
+	var started int32
+	err := ParallelSegmentLoop(context.Background(), 100, 10, 2, func(ctx context.Context, start, end int) error {
+		atomic.AddInt32(&started, 1)
+		if start == 0 {
+			return errSegment
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	var segmentErrs SegmentErrors
+	if !errors.As(err, &segmentErrs) || !errors.Is(err, errSegment) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(segmentErrs) != 1 || segmentErrs[0].Start != 0 || segmentErrs[0].End != 10 {
+		t.Fatalf("cancelled segments shouldn't be errors: %v", err)
+	}
+	if started > 3 {
+		t.Fatalf("no more segments should start after an error: %v", started)
+	}
+}
+
+func TestParallelSegmentLoopCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	err := ParallelSegmentLoop(ctx, 10, 5, 2, func(ctx context.Context, start, end int) error {
+		called = true
+		return nil
+	})
+	if err != context.Canceled || called {
+		t.Fatalf("cancelled loop shouldn't run segments: %v", err)
+	}
+}